@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jobStartedKey carries the function runScript calls once its job started
+type jobStartedKey struct{}
+
+// onJobStart returns a context asking runScript to call f with its job, as
+// soon as the script started, after what ctx already asked for
+func onJobStart(ctx context.Context, f func(*job)) context.Context {
+	prev, _ := ctx.Value(jobStartedKey{}).(func(*job))
+	return context.WithValue(ctx, jobStartedKey{}, func(j *job) {
+		if prev != nil {
+			prev(j)
+		}
+		f(j)
+	})
+}
+
+// jobStarted tells the caller of runScript which job it got
+func jobStarted(ctx context.Context, j *job) {
+	if f, ok := ctx.Value(jobStartedKey{}).(func(*job)); ok {
+		f(j)
+	}
+}
+
+// detachedContext keeps the values of a request context, the request id
+// and logger, without ending with the request
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// preferAsync tells if the client asked not to wait for the script,
+// with "Prefer: respond-async" (RFC 7240)
+func preferAsync(r *http.Request) bool {
+	for _, p := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(p), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedResponse keeps the answer of an operation nobody waits for
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) Header() http.Header         { return br.header }
+func (br *bufferedResponse) Write(p []byte) (int, error) { return br.body.Write(p) }
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+// writeTo answers w with what was buffered
+func (br *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for k, v := range br.header {
+		w.Header()[k] = v
+	}
+	if br.status != 0 {
+		w.WriteHeader(br.status)
+	}
+	w.Write(br.body.Bytes())
+}
+
+// runAsync answers 202 as soon as the script of op started, with its job
+// in Location so its output can be streamed live. The operation goes on
+// without the client, its answer is kept with the job. What is refused
+// before the script starts is answered as usual.
+func (oh opHandler) runAsync(w http.ResponseWriter, r *http.Request, op *operation, hooks opHooks) {
+	started := make(chan *job, 1)
+	done := make(chan struct{})
+	br := &bufferedResponse{header: http.Header{}}
+
+	var j *job
+	ctx := onJobStart(detachedContext{r.Context()}, func(sj *job) {
+		j = sj
+		started <- sj
+	})
+	go func() {
+		defer close(done)
+		oh.execute(br, r.WithContext(ctx), op, hooks)
+		if j != nil {
+			status := br.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			j.setAnswer(status, br.body.String())
+		}
+	}()
+
+	select {
+	case sj := <-started:
+		w.Header().Set("X-Job-ID", sj.ID)
+		w.Header().Set("Location", "/jobs/"+sj.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(sj.info())
+	case <-done:
+		br.writeTo(w)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the audit log is kept in the store, newest entry first, capped to
+// maxAuditEntries. In redis it is a list.
+const (
+	auditKey        = "audit"
+	maxAuditEntries = 10000
+)
+
+const (
+	// defaultAuditPage is how many entries GET /audit returns by default
+	defaultAuditPage = 50
+	// auditFailureScan is how far back GET /audit?failed=true looks
+	auditFailureScan = 1000
+)
+
+// auditEntry records one call to an operation
+type auditEntry struct {
+	Time      time.Time
+	RequestID string `json:",omitempty"`
+	Operation string
+	Role      string
+	Author    string `json:",omitempty"`
+	// Identity is the owner of the client certificate, when mTLS is on
+	Identity   string `json:",omitempty"`
+	Group      string `json:",omitempty"`
+	JobID      string `json:",omitempty"`
+	Status     int
+	Error      string `json:",omitempty"`
+	DurationMs int64
+}
+
+// audit appends e to the audit log. A failure is logged, it never fails the
+// request being audited.
+func (uh userHandler) audit(ctx context.Context, e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	if err := uh.store.audit(ctx, e); err != nil {
+		loggerFrom(ctx).Warn("failed to write audit entry", "operation", e.Operation, "error", err)
+	}
+}
+
+// getAudit returns the newest entries of the audit log to the admins, at
+// most n of them, only the failed calls with failed=true
+func (uh userHandler) getAudit(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		loggerFrom(r.Context()).Warn("wrong admin password", "path", r.URL.Path)
+		http.Error(w, "Wrong Password", http.StatusForbidden)
+		return
+	}
+
+	n := defaultAuditPage
+	if s := r.URL.Query().Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v <= 0 {
+			http.Error(w, "n must be a positive number", http.StatusBadRequest)
+			return
+		}
+		if n = v; n > maxAuditEntries {
+			n = maxAuditEntries
+		}
+	}
+	failed := r.URL.Query().Get("failed") == "true"
+
+	scan := n
+	if failed && scan < auditFailureScan {
+		scan = auditFailureScan
+	}
+	entries, err := uh.store.auditLog(r.Context(), scan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := []auditEntry{}
+	for _, e := range entries {
+		if len(page) == n {
+			break
+		}
+		if !failed || e.Status >= http.StatusBadRequest {
+			page = append(page, e)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
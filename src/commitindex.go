@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// commitIndexFreshness is how long after a refresh, failed or not, a commit
+// missing from the index of a group is taken as not on chain, without
+// running gethistory.sh again
+const commitIndexFreshness = 30 * time.Second
+
+// sources of a commit lookup
+const (
+	sourceCache = "cache"
+	sourceChain = "chain"
+)
+
+// commitRecord is the answer of a commit lookup
+type commitRecord struct {
+	Group    string
+	Commit   string
+	Recorded bool
+	// Author, Timestamp and TxID are those of the first push of the
+	// commit, when it is recorded
+	Author    string `json:",omitempty"`
+	Timestamp string `json:",omitempty"`
+	TxID      string `json:"TxId,omitempty"`
+	// Source tells if the index answered or the chain had to be asked
+	Source string
+}
+
+// firstPushes keeps the earliest entry of each commit of entries, keyed by
+// the lower case commit so that lookups don't depend on the case
+func firstPushes(entries []historyEntry) map[string]historyEntry {
+	first := map[string]historyEntry{}
+	for _, e := range entries {
+		if e.Commit == "" {
+			continue
+		}
+		c := strings.ToLower(e.Commit)
+		if seen, ok := first[c]; !ok || e.Timestamp < seen.Timestamp {
+			first[c] = e
+		}
+	}
+	return first
+}
+
+// indexHistory replaces the commit index of a group with the history the
+// client asked for
+func (uh userHandler) indexHistory(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	entries, ok := resp.Result.([]historyEntry)
+	if !ok {
+		return
+	}
+	if err := uh.store.indexCommits(ctx, cp.Group, entries, true); err != nil {
+		loggerFrom(ctx).Warn("failed to index commits", "group", cp.Group, "error", err)
+	}
+}
+
+// indexPush adds a successful push to the commit index of its group, until
+// the next refresh brings the timestamp of the chain
+func (uh userHandler) indexPush(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	entry := historyEntry{
+		TxID:      pushTxID(resp.Response),
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Author:    cp.Author,
+		Group:     cp.Group,
+		Commit:    cp.Commit,
+	}
+	if err := uh.store.indexCommits(ctx, cp.Group, []historyEntry{entry}, false); err != nil {
+		loggerFrom(ctx).Warn("failed to index commit", "group", cp.Group, "commit", cp.Commit, "error", err)
+	}
+}
+
+// historyOf runs history for group and returns its entries, which also
+// replace the commit index of the group
+func (oh opHandler) historyOf(ctx context.Context, w http.ResponseWriter, history *operation, group string) ([]historyEntry, error) {
+	args, err := history.bindArgs(map[string]interface{}{"Group": group})
+	if err != nil {
+		return nil, &scriptError{http.StatusBadRequest, err.Error()}
+	}
+	results, err := runScript(ctx, w, history, args, group)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := history.parseOutput(results)
+	entries, ok := parsed.([]historyEntry)
+	if err != nil || !ok {
+		loggerFrom(ctx).Warn("can't parse the history", "group", group, "error", err)
+		return nil, &scriptError{http.StatusBadGateway, "Can't read the history of " + group}
+	}
+	if err := oh.uh.store.indexCommits(ctx, group, entries, true); err != nil {
+		loggerFrom(ctx).Warn("failed to index commits", "group", group, "error", err)
+	}
+	return entries, nil
+}
+
+// getCommit tells if a commit is on chain for a group, from the index or,
+// when it misses and is not fresh, from the history op
+func (oh opHandler) getCommit(history *operation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		group, hash := vars["Group"], strings.ToLower(vars["Hash"])
+
+		entry, found, refreshed, err := oh.uh.store.indexedCommit(r.Context(), group, hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		source := sourceCache
+
+		if !found && history != nil && time.Since(refreshed) > commitIndexFreshness {
+			entries, err := oh.historyOf(r.Context(), w, history, group)
+			if err != nil {
+				// anyone may ask, so a group whose history fails, one that
+				// doesn't exist say, is not asked again until it is due
+				if err != errNetworkBusy {
+					if ferr := oh.uh.store.failRefresh(r.Context(), group, commitIndexFreshness); ferr != nil {
+						loggerFrom(r.Context()).Warn("failed to record the failed refresh", "group", group, "error", ferr)
+					}
+				}
+				writeScriptError(w, err)
+				return
+			}
+			entry, found = firstPushes(entries)[hash]
+			source = sourceChain
+		}
+
+		rec := commitRecord{Group: group, Commit: hash, Recorded: found, Source: source}
+		if found {
+			rec.Author, rec.Timestamp, rec.TxID = entry.Author, entry.Timestamp, entry.TxID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		json.NewEncoder(w).Encode(rec)
+	}
+}
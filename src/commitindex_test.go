@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetCommit(t *testing.T) {
+	env := newTestEnv(t)
+	history := `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "bob", "Group": "g1", "Commit": "def456"}]`
+	env.vm.script("gethistory.sh", scriptResult{Stdout: "Querying peer0\n" + history + "\n"})
+	env.vm.script("push.sh", scriptResult{Stdout: "Commit abc123 pushed to channel 'g1', transaction 9f86d081884c7d65\n"})
+
+	// lookup returns the answer for hash and the gethistory.sh runs it took
+	lookup := func(path string) (int, commitRecord, int) {
+		t.Helper()
+		before := 0
+		for _, c := range env.vm.Commands() {
+			if strings.Contains(c, "gethistory.sh") {
+				before++
+			}
+		}
+		resp := env.get(t, path)
+		defer resp.Body.Close()
+		var rec commitRecord
+		json.NewDecoder(resp.Body).Decode(&rec)
+		after := 0
+		for _, c := range env.vm.Commands() {
+			if strings.Contains(c, "gethistory.sh") {
+				after++
+			}
+		}
+		return resp.StatusCode, rec, after - before
+	}
+
+	env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"}).Body.Close()
+	status, rec, runs := lookup("/v1/groups/g1/commits/abc123")
+	if status != http.StatusOK || !rec.Recorded || rec.Author != "alice" || rec.TxID != "9f86d081884c7d65" || rec.Source != sourceCache || runs != 0 {
+		t.Errorf("expected the push to be answered from the index, got %d %+v after %d runs", status, rec, runs)
+	}
+
+	// pushed before the index existed, only the chain knows it
+	status, rec, runs = lookup("/v1/groups/g1/commits/def456")
+	if status != http.StatusOK || !rec.Recorded || rec.Author != "bob" || rec.TxID != "tx1" || rec.Source != sourceChain || runs != 1 {
+		t.Errorf("expected def456 from the chain, got %d %+v after %d runs", status, rec, runs)
+	}
+
+	// the index was just refreshed, a miss is final
+	status, rec, runs = lookup("/groups/g1/commits/0badc0de")
+	if status != http.StatusNotFound || rec.Recorded || rec.Source != sourceCache || runs != 0 {
+		t.Errorf("expected an unknown commit from the fresh index, got %d %+v after %d runs", status, rec, runs)
+	}
+	if status, _, runs = lookup("/v1/groups/g1/commits/def456"); status != http.StatusOK || runs != 0 {
+		t.Errorf("expected def456 to be indexed, got %d after %d runs", status, runs)
+	}
+
+	// a group with no fresh index asks the chain
+	status, rec, runs = lookup("/v1/groups/g2/commits/0badc0de")
+	if status != http.StatusNotFound || rec.Source != sourceChain || runs != 1 {
+		t.Errorf("expected the chain to be asked for g2, got %d %+v after %d runs", status, rec, runs)
+	}
+	if status, _, _ := lookup("/v1/groups/g$1/commits/abc123"); status != http.StatusBadRequest {
+		t.Errorf("expected a bad group to be refused, got %d", status)
+	}
+
+	// the case of the hash doesn't matter
+	status, rec, runs = lookup("/v1/groups/g1/commits/DEF456")
+	if status != http.StatusOK || rec.Commit != "def456" || rec.Source != sourceCache || runs != 0 {
+		t.Errorf("expected DEF456 from the index, got %d %+v after %d runs", status, rec, runs)
+	}
+
+	// a group the chain doesn't know is not asked again until it is due
+	env.vm.script("gethistory.sh", scriptResult{Stderr: "Error: channel 'nosuch' not found\n", Status: 1})
+	if status, _, runs = lookup("/v1/groups/nosuch/commits/abc123"); status == http.StatusOK || runs != 1 {
+		t.Errorf("expected the chain to be asked for nosuch, got %d after %d runs", status, runs)
+	}
+	status, rec, runs = lookup("/v1/groups/nosuch/commits/abc123")
+	if status != http.StatusNotFound || rec.Source != sourceCache || runs != 0 {
+		t.Errorf("expected the failed refresh to hold, got %d %+v after %d runs", status, rec, runs)
+	}
+}
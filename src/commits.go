@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// limits on the metadata a client may attach to a push
+const (
+	maxMessageLength   = 4096
+	maxArtifacts       = 1000
+	maxArtifactPath    = 1024
+	maxClientVersion   = 64
+	maxMetadataPayload = 256 << 10
+)
+
+// artifact is a file touched by a commit, with the hash of its content
+type artifact struct {
+	Path string
+	Hash string
+}
+
+// commitMetadata is what the client tells about a pushed commit, kept off
+// chain next to its hash
+type commitMetadata struct {
+	Message       string     `json:",omitempty"`
+	Artifacts     []artifact `json:",omitempty"`
+	ClientVersion string     `json:",omitempty"`
+	// Timestamp is when the client made the commit, RFC 3339
+	Timestamp string `json:",omitempty"`
+	// Received is when the server recorded the push
+	Received time.Time
+	// Signed is the verified signature of the push, if it was signed
+	Signed *pushSignature `json:",omitempty"`
+}
+
+// empty tells if the client sent no metadata at all
+func (m commitMetadata) empty() bool {
+	return m.Message == "" && len(m.Artifacts) == 0 && m.ClientVersion == "" && m.Timestamp == ""
+}
+
+// checkCommitMetadata reads the metadata fields of a push body into cp
+func checkCommitMetadata(body []byte, cp *ContentPost) error {
+	if len(body) > maxMetadataPayload {
+		return fmt.Errorf("body larger than %d bytes", maxMetadataPayload)
+	}
+	var meta commitMetadata
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &meta); err != nil {
+			return err
+		}
+	}
+	if err := meta.validate(); err != nil {
+		return err
+	}
+	if !meta.empty() {
+		// set by the server, not the client
+		meta.Received, meta.Signed = time.Time{}, nil
+		cp.Metadata = &meta
+	}
+	return nil
+}
+
+func (m commitMetadata) validate() error {
+	if len(m.Message) > maxMessageLength {
+		return fmt.Errorf("Message longer than %d bytes", maxMessageLength)
+	}
+	if len(m.ClientVersion) > maxClientVersion {
+		return fmt.Errorf("ClientVersion longer than %d bytes", maxClientVersion)
+	}
+	if m.Timestamp != "" {
+		if _, err := time.Parse(time.RFC3339, m.Timestamp); err != nil {
+			return fmt.Errorf("Timestamp must be RFC 3339: %v", err)
+		}
+	}
+	if len(m.Artifacts) > maxArtifacts {
+		return fmt.Errorf("more than %d Artifacts", maxArtifacts)
+	}
+	for i, a := range m.Artifacts {
+		if a.Path == "" || len(a.Path) > maxArtifactPath {
+			return fmt.Errorf("Artifacts[%d].Path must be 1 to %d bytes", i, maxArtifactPath)
+		}
+		if !argTypes["hash"].MatchString(a.Hash) {
+			return fmt.Errorf("Artifacts[%d].Hash must be a hash", i)
+		}
+	}
+	return nil
+}
+
+// saveCommit records the metadata and verified signature of a successful
+// push. A failure is logged, the commit is on chain whatever happens here.
+func (uh userHandler) saveCommit(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	signed := cp.Signature != nil && cp.Signature.Key != ""
+	if cp.Metadata == nil && !signed {
+		return
+	}
+	var meta commitMetadata
+	if cp.Metadata != nil {
+		meta = *cp.Metadata
+	}
+	if signed {
+		meta.Signed = cp.Signature
+	}
+	meta.Received = time.Now().UTC()
+	if err := uh.store.saveCommit(ctx, cp.Group, cp.Commit, meta); err != nil {
+		loggerFrom(ctx).Warn("failed to record commit metadata", "group", cp.Group, "commit", cp.Commit, "error", err)
+	}
+}
+
+// mergeCommits completes the history of a group with the metadata of its
+// commits. Without it the history is still returned.
+func (uh userHandler) mergeCommits(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	entries, ok := resp.Result.([]historyEntry)
+	if !ok {
+		return
+	}
+	if err := uh.attachMetadata(ctx, cp.Group, entries); err != nil {
+		loggerFrom(ctx).Warn("failed to read commit metadata", "group", cp.Group, "error", err)
+	}
+}
+
+// attachMetadata sets the metadata recorded for the commits of entries,
+// pushed to group
+func (uh userHandler) attachMetadata(ctx context.Context, group string, entries []historyEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	hashes := make([]string, 0, len(entries))
+	for _, e := range entries {
+		hashes = append(hashes, e.Commit)
+	}
+	metas, err := uh.store.commits(ctx, group, hashes)
+	if err != nil {
+		return err
+	}
+	for i := range entries {
+		if meta, ok := metas[entries[i].Commit]; ok {
+			entries[i].Metadata = &meta
+		}
+	}
+	return nil
+}
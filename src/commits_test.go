@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckCommitMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		err  string
+	}{
+		{`{"Author": "alice"}`, ""},
+		{`{"Message": "fix", "Artifacts": [{"Path": "a.txt", "Hash": "00ff"}], "ClientVersion": "1.2.0", "Timestamp": "2021-03-01T10:00:00+01:00"}`, ""},
+		{`{"Message": 3}`, "cannot unmarshal"},
+		{`{"Timestamp": "yesterday"}`, "Timestamp must be RFC 3339"},
+		{`{"Artifacts": [{"Path": "", "Hash": "00ff"}]}`, "Artifacts[0].Path"},
+		{`{"Artifacts": [{"Path": "a.txt", "Hash": "not hex"}]}`, "Artifacts[0].Hash"},
+		{`{"Message": "` + strings.Repeat("x", maxMessageLength+1) + `"}`, "Message longer"},
+	} {
+		var cp ContentPost
+		err := checkCommitMetadata([]byte(tc.body), &cp)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%.60s: expected error %q, got %v", tc.body, tc.err, err)
+		}
+	}
+
+	var cp ContentPost
+	checkCommitMetadata([]byte(`{"Author": "alice", "Received": "2000-01-01T00:00:00Z"}`), &cp)
+	if cp.Metadata != nil {
+		t.Errorf("expected no metadata, got %+v", cp.Metadata)
+	}
+}
+
+func TestPushMetadataInHistory(t *testing.T) {
+	env := newTestEnv(t)
+	history := `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "alice", "Group": "g1", "Commit": "abc123"},
+		{"TxId": "tx2", "Timestamp": "2021-03-01T11:00:00Z", "Author": "bob", "Group": "g1", "Commit": "def456"}]`
+	env.vm.script("gethistory.sh", scriptResult{Stdout: history + "\n"})
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+
+	resp := env.post(t, "/push", "", map[string]interface{}{
+		"Author": "alice", "Group": "g1", "Commit": "abc123",
+		"Message":       "Add the parser",
+		"Artifacts":     []artifact{{Path: "src/parser.go", Hash: "a1b2c3d4"}},
+		"ClientVersion": "gatherchain-cli 1.4.0",
+		"Timestamp":     "2021-03-01T09:59:00Z",
+	})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the push to succeed, got %d: %s", resp.StatusCode, body)
+	}
+	// only the arguments reach the script
+	cmds := env.vm.Commands()
+	if want := `/push.sh' 'alice' 'g1' 'abc123'`; !strings.HasSuffix(cmds[len(cmds)-1], want) {
+		t.Errorf("expected %q, got %q", want, cmds[len(cmds)-1])
+	}
+
+	resp = env.post(t, "/push", "", map[string]interface{}{"Author": "bob", "Group": "g1", "Commit": "def456", "Timestamp": "now"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "Timestamp") {
+		t.Errorf("expected bad metadata to be refused, got %d: %s", resp.StatusCode, body)
+	}
+
+	var got struct{ Result []historyEntry }
+	json.NewDecoder(env.post(t, "/history", "", map[string]interface{}{"Group": "g1"}).Body).Decode(&got)
+	if len(got.Result) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", got.Result)
+	}
+	meta := got.Result[0].Metadata
+	if meta == nil || meta.Message != "Add the parser" || len(meta.Artifacts) != 1 || meta.Artifacts[0].Path != "src/parser.go" ||
+		meta.ClientVersion != "gatherchain-cli 1.4.0" || meta.Timestamp != "2021-03-01T09:59:00Z" || time.Since(meta.Received) > time.Minute {
+		t.Errorf("expected the metadata of abc123, got %+v", meta)
+	}
+	if got.Result[1].Metadata != nil {
+		t.Errorf("expected no metadata for def456, got %+v", got.Result[1].Metadata)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConf writes a config file in a temporary directory
+func writeConf(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	name := filepath.Join(dir, "app.conf")
+	if err := ioutil.WriteFile(name, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key, value string) {
+	old, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+const validConf = `
+appname = gatherchain-app
+runmode = "dev"
+httpport = 8010
+vmhost = 10.0.0.4
+vmusername = azureuser
+vmpassword = from-file
+redishost = cache:6380
+pushtimeout = 45s
+`
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	name := writeConf(t, validConf)
+	setenv(t, "HTTP_PORT", "9000")
+	setenv(t, "VM_PASSWORD", "from-env")
+
+	c, err := loadConfig([]string{"-config", name, "-httpport", "9100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.HTTPPort != 9100 {
+		t.Errorf("expected flag to win, got port %d", c.HTTPPort)
+	}
+	if c.VMPassword.Get() != "from-env" {
+		t.Errorf("expected env to win over the file, got %q", c.VMPassword.Get())
+	}
+	if c.VMHost != "10.0.0.4" || c.RunMode != "dev" {
+		t.Errorf("expected file values, got %q %q", c.VMHost, c.RunMode)
+	}
+	if c.ScriptTimeouts["push.sh"] != 45*time.Second {
+		t.Errorf("expected push timeout from file, got %s", c.ScriptTimeouts["push.sh"])
+	}
+	if c.vmAddr() != "10.0.0.4:22" {
+		t.Errorf("unexpected vm address %q", c.vmAddr())
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	name := writeConf(t, validConf+"vmpasword = typo\n")
+
+	_, err := loadConfig([]string{"-config", name})
+	if err == nil || !strings.Contains(err.Error(), "unknown setting") {
+		t.Fatalf("expected unknown setting error, got %v", err)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	name := writeConf(t, "httpport = 0\nscriptsdir = relative/path\n")
+
+	_, err := loadConfig([]string{"-config", name})
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"httpport", "vmhost", "scriptsdir"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestWriteConfigRedactsSecrets(t *testing.T) {
+	name := writeConf(t, validConf+"redispassword = hunter2\n")
+
+	c, err := loadConfig([]string{"-config", name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	c.write(&out)
+	if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "from-file") {
+		t.Fatalf("secrets leaked in\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "redispassword = "+redacted) {
+		t.Errorf("expected redacted password in\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "vmhost = 10.0.0.4") {
+		t.Errorf("expected vmhost in\n%s", out.String())
+	}
+}
+
+func TestLoadConfigRedisModes(t *testing.T) {
+	for _, tc := range []struct {
+		conf string
+		want string
+	}{
+		{"redismode = sentinel\n", "redismastername"},
+		{"redismode = cluster\nredisdb = 2\n", "redisdb must be 0"},
+		{"redismode = replica\n", "redismode"},
+		{"redisurl = http://cache\n", "redisurl is invalid"},
+		{"redismode = sentinel\nredismastername = mymaster\nredisurl = redis://cache:6379\n", "only applies to a standalone"},
+		{"redistls = false\nrediscafile = /etc/ca.pem\n", "rediscafile needs redistls"},
+	} {
+		_, err := loadConfig([]string{"-config", writeConf(t, validConf+tc.conf)})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: expected %q, got %v", tc.conf, tc.want, err)
+		}
+	}
+
+	c, err := loadConfig([]string{"-config", writeConf(t, validConf+"redismode = cluster\nredishost = n1:6379, n2:6379\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RedisMode != redisCluster || !c.RedisTLS {
+		t.Errorf("unexpected redis settings %+v", c)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers the browser portal may read
+const corsExposedHeaders = "X-Request-ID, X-Job-ID, Location"
+
+// splitList splits a comma separated setting, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin answering origin, or
+// "" if it is not allowed
+func corsOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range splitList(cfg.CORSOrigins) {
+		switch {
+		case allowed == "*":
+			return "*"
+		case strings.EqualFold(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors lets the browser portal, served from another origin, call the API.
+// Preflights from allowed origins are answered here, see preflight for the
+// others.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := corsOrigin(origin)
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if allowed == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", allowed)
+		// never for *, validate refuses it but any origin would get them
+		if cfg.CORSCredentials && allowed != "*" {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", strings.Join(splitList(cfg.CORSMethods), ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(splitList(cfg.CORSHeaders), ", "))
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.CORSMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// preflight answers the OPTIONS requests cors did not, so they get an empty
+// answer rather than a 405
+func preflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", strings.Join(splitList(cfg.CORSMethods), ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkWebSocketOrigin lets the allowed origins, besides the server itself,
+// open the group feeds
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return corsOrigin(origin) != ""
+}
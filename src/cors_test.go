@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// request sends an empty request with the given headers
+func (env *testEnv) request(t *testing.T, method, path string, header map[string]string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, env.srv.URL+path, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORS(t *testing.T) {
+	env := newTestEnv(t)
+	cfg.CORSOrigins = "https://portal.example.edu, https://staging.example.edu"
+	portal := map[string]string{"Origin": "https://portal.example.edu"}
+
+	resp := env.request(t, "OPTIONS", "/push", map[string]string{
+		"Origin":                         "https://portal.example.edu",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "Content-Type",
+	})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected the preflight to answer 204, got %d", resp.StatusCode)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://portal.example.edu",
+		"Access-Control-Allow-Methods": "GET, POST, PUT, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type, X-Request-ID, Last-Event-ID, Prefer, X-Admin-Password",
+		"Access-Control-Max-Age":       "600",
+		"Vary":                         "Origin",
+	} {
+		if got := resp.Header.Get(header); got != want {
+			t.Errorf("expected %s %q, got %q", header, want, got)
+		}
+	}
+	if resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("expected no credentials without corscredentials")
+	}
+
+	// the portal registers the keys of the students
+	resp = env.request(t, "OPTIONS", "/users/alice/key", map[string]string{
+		"Origin":                        "https://portal.example.edu",
+		"Access-Control-Request-Method": "PUT",
+	})
+	if resp.StatusCode != http.StatusNoContent || !strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "PUT") {
+		t.Errorf("expected PUT to pass the preflight, got %d %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Methods"))
+	}
+
+	resp = env.request(t, "GET", "/healthz", portal)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://portal.example.edu" {
+		t.Errorf("expected the portal to be allowed, got %q", got)
+	}
+	if got := resp.Header.Get("Access-Control-Expose-Headers"); !strings.Contains(got, "X-Job-ID") {
+		t.Errorf("expected X-Job-ID to be exposed, got %q", got)
+	}
+
+	resp = env.request(t, "OPTIONS", "/push", map[string]string{
+		"Origin":                        "https://evil.example.com",
+		"Access-Control-Request-Method": "POST",
+	})
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected an unknown origin to get no CORS headers, got %d %q", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	cfg.CORSCredentials = true
+	resp = env.request(t, "GET", "/healthz", portal)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://portal.example.edu" || resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("expected the origin to be echoed with credentials, got %q %q",
+			resp.Header.Get("Access-Control-Allow-Origin"), resp.Header.Get("Access-Control-Allow-Credentials"))
+	}
+
+	// any origin never gets credentials
+	cfg.CORSOrigins = "*"
+	resp = env.request(t, "GET", "/healthz", portal)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "*" || resp.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("expected * without credentials, got %q %q",
+			resp.Header.Get("Access-Control-Allow-Origin"), resp.Header.Get("Access-Control-Allow-Credentials"))
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp := env.request(t, "GET", "/healthz", map[string]string{"Origin": "https://portal.example.edu"})
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected no CORS headers by default, got %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	// the preflight route must not turn unknown paths into a 405
+	if resp := env.request(t, "GET", "/nothing-here", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected unknown paths to answer 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	env := newTestEnv(t)
+	cfg.CORSOrigins = "https://portal.example.edu"
+	url := "ws" + strings.TrimPrefix(env.srv.URL, "http") + "/events/g1"
+
+	for origin, allowed := range map[string]bool{
+		"":                           true,
+		env.srv.URL:                  true,
+		"https://portal.example.edu": true,
+		"https://evil.example.com":   false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		ws, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if allowed != (err == nil) {
+			t.Errorf("origin %q: expected allowed %v, got %v", origin, allowed, err)
+		}
+		if ws != nil {
+			ws.Close()
+		} else if resp != nil && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q: expected 403, got %d", origin, resp.StatusCode)
+		}
+	}
+}
+
+func TestLoadConfigCORS(t *testing.T) {
+	_, err := loadConfig([]string{"-config", writeConf(t, validConf+"corsorigins = portal.example.edu, *\ncorsmaxage = -1s\ncorscredentials = true\n")})
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"cors origin \"portal.example.edu\"", "corsmaxage", "corscredentials can't go with corsorigins *"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// customReloadInterval is how often the custom operations file is checked
+// for changes
+const customReloadInterval = 10 * time.Second
+
+// customRegistry holds the operations admins define on top of the built in
+// ones, served under /ops/{Name}. The file is reloaded when it changes, a
+// broken file leaves the previous operations in place.
+type customRegistry struct {
+	mu      sync.RWMutex
+	file    string
+	modTime time.Time
+	reg     *registry
+}
+
+var customOps = &customRegistry{reg: &registry{byName: map[string]*operation{}}}
+
+// get returns the custom operation called name, if any
+func (cr *customRegistry) get(name string) *operation {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.reg.byName[name]
+}
+
+// list returns the custom operations in definition order
+func (cr *customRegistry) list() []*operation {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return append([]*operation(nil), cr.reg.ops...)
+}
+
+// load reads file, used at startup where a broken file is fatal
+func (cr *customRegistry) load(file string) error {
+	cr.mu.Lock()
+	cr.file = file
+	cr.mu.Unlock()
+	if file == "" {
+		return nil
+	}
+	_, err := cr.reload(true)
+	return err
+}
+
+// reload reads the file again if it changed since the last load, or always
+// when force is set. It tells if the operations were replaced.
+func (cr *customRegistry) reload(force bool) (bool, error) {
+	cr.mu.RLock()
+	file, last := cr.file, cr.modTime
+	cr.mu.RUnlock()
+	if file == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	if !force && info.ModTime().Equal(last) {
+		return false, nil
+	}
+
+	reg, err := loadOperations(file)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.Lock()
+	cr.reg, cr.modTime = reg, info.ModTime()
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// reloadAndLog reloads the operations and logs the outcome
+func (cr *customRegistry) reloadAndLog(force bool) {
+	changed, err := cr.reload(force)
+	switch {
+	case err != nil:
+		logger.Error("failed to reload custom operations, keeping the previous ones", "file", cr.file, "error", err)
+	case changed:
+		logger.Info("reloaded custom operations", "file", cr.file, "count", len(cr.list()))
+	}
+}
+
+// watch reloads the operations whenever the file changes, until ctx is done
+func (cr *customRegistry) watch(ctx context.Context) {
+	ticker := time.NewTicker(customReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cr.reloadAndLog(false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// listCustom returns the definitions of the custom operations so clients
+// can discover them
+func (oh opHandler) listCustom(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customOps.list())
+}
+
+// serveCustom runs a custom operation. They go through the same role,
+// validation, lock and audit path as the built in ones, without their
+// side effects.
+func (oh opHandler) serveCustom(w http.ResponseWriter, r *http.Request) {
+	op := customOps.get(mux.Vars(r)["Name"])
+	if op == nil {
+		http.Error(w, "Unknown operation", http.StatusNotFound)
+		return
+	}
+	oh.run(w, r, op, oh.hooks[op.scriptName()])
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func writeOps(t *testing.T, file, data string, mod time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCustomOperationsReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "custom.json")
+	now := time.Now()
+	writeOps(t, file, `[{"Name": "channels", "Script": "listchannels.sh", "Role": "admin"}]`, now)
+
+	cr := &customRegistry{reg: &registry{byName: map[string]*operation{}}}
+	if err := cr.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if op := cr.get("channels"); op == nil || op.Role != roleAdmin {
+		t.Fatalf("expected the channels operation, got %+v", op)
+	}
+
+	if changed, err := cr.reload(false); changed || err != nil {
+		t.Fatalf("expected an unchanged file to be skipped, got %v %v", changed, err)
+	}
+
+	writeOps(t, file, `[{"Name": "peers", "Script": "querypeers.sh", "Role": "student",
+		"Args": [{"Name": "Group", "Type": "name", "Required": true}]}]`, now.Add(time.Second))
+	if changed, err := cr.reload(false); !changed || err != nil {
+		t.Fatalf("expected the file to be reloaded, got %v %v", changed, err)
+	}
+	if cr.get("channels") != nil || cr.get("peers") == nil {
+		t.Fatalf("expected the new definitions, got %+v", cr.list())
+	}
+
+	writeOps(t, file, `[{"Name": "peers", "Script": "querypeers.sh", "Role": "root"}]`, now.Add(2*time.Second))
+	if _, err := cr.reload(false); err == nil {
+		t.Fatal("expected an invalid file to be rejected")
+	}
+	if cr.get("peers") == nil {
+		t.Fatal("expected the previous definitions to be kept")
+	}
+}
+
+func TestCustomOperationsUnknown(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/ops/{Name}", opHandler{}.serveCustom).Methods("POST")
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("POST", "/ops/nothere", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFiles is the teacher dashboard, a static page calling the API
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardPolicy keeps the dashboard to its own files and the API, the
+// admin password it holds must not leak to another origin
+const dashboardPolicy = "default-src 'self'; frame-ancestors 'none'; form-action 'self'"
+
+// dashboardHandler serves the files of the dashboard under /dashboard/
+func dashboardHandler() http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	fileServer := http.StripPrefix("/dashboard", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the page links its files relatively
+		if r.URL.Path == "/dashboard" {
+			http.Redirect(w, r, "/dashboard/", http.StatusMovedPermanently)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Security-Policy", dashboardPolicy)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
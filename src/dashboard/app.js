@@ -0,0 +1,195 @@
+// Teacher dashboard. Everything goes through the public API: the admin
+// password is kept for the tab only and sent as the Author of the admin
+// operations, or in the X-Admin-Password header of the admin GET routes.
+"use strict";
+
+const refreshInterval = 5000;
+
+let password = sessionStorage.getItem("password") || "";
+
+const $ = (selector) => document.querySelector(selector);
+
+// cell returns a table cell holding text, never parsed as html
+function cell(text, className) {
+	const td = document.createElement("td");
+	td.textContent = text === undefined || text === null ? "" : String(text);
+	if (className) {
+		td.className = className;
+	}
+	return td;
+}
+
+function fillTable(table, rows) {
+	const body = table.querySelector("tbody");
+	body.replaceChildren(...rows.map((cells) => {
+		const tr = document.createElement("tr");
+		tr.append(...cells);
+		return tr;
+	}));
+}
+
+// api calls the server and decodes its json answer, the statuses in also
+// are not errors
+async function api(method, path, body, also = []) {
+	const init = {method, headers: {}};
+	if (password) {
+		init.headers["X-Admin-Password"] = password;
+	}
+	if (body !== undefined) {
+		init.headers["Content-Type"] = "application/json";
+		init.body = JSON.stringify(body);
+	}
+	const resp = await fetch(path, init);
+	const text = await resp.text();
+	if (!resp.ok && !also.includes(resp.status)) {
+		const err = new Error(text.trim() || resp.statusText);
+		err.status = resp.status;
+		throw err;
+	}
+	return text ? JSON.parse(text) : null;
+}
+
+async function refreshServer() {
+	// an unready server still reports what is wrong
+	const report = await api("GET", "/readyz", undefined, [503]);
+	const status = $("#status");
+	status.textContent = report.Status;
+	status.className = "badge " + (report.Status === "ready" ? "ok" : "failed");
+
+	const dl = $("#server");
+	const items = [["Network lock", report.Locks.Global ? "held" : "free"],
+		["Locked groups", report.Locks.Groups.join(", ") || "none"]];
+	for (const [name, check] of Object.entries(report.Checks)) {
+		items.push([name, check.Status + (check.Error ? ": " + check.Error : "")]);
+	}
+	dl.replaceChildren(...items.flatMap(([term, value]) => {
+		const dt = document.createElement("dt");
+		const dd = document.createElement("dd");
+		dt.textContent = term;
+		dd.textContent = value;
+		return [dt, dd];
+	}));
+
+	const jobs = await api("GET", "/jobs");
+	fillTable($("#jobs"), jobs.map((j) => [cell(j.ID, "hash"), cell(j.Script), cell(j.State),
+		cell(new Date(j.Started).toLocaleTimeString())]));
+}
+
+async function refreshGroups() {
+	const groups = await api("GET", "/groups");
+	fillTable($("#groups"), groups.map((g) => {
+		const button = document.createElement("button");
+		button.textContent = "Commits";
+		button.addEventListener("click", () => showTimeline(g.Name));
+		const td = document.createElement("td");
+		td.append(button);
+		return [cell(g.Name), cell(g.Members.join(", ")), td];
+	}));
+}
+
+async function showTimeline(group) {
+	$("#timeline").hidden = false;
+	$("#timeline-group").textContent = group;
+	const table = $("#timeline table");
+	fillTable(table, [[cell("Loading…")]]);
+	try {
+		const resp = await api("POST", "/history", {Group: group});
+		const entries = (resp.Result || []).slice().sort((a, b) => a.Timestamp < b.Timestamp ? -1 : 1);
+		fillTable(table, entries.map((e) => [cell(e.Timestamp), cell(e.Author),
+			cell(e.Commit, "hash"), cell(e.TxId, "hash")]));
+	} catch (err) {
+		fillTable(table, [[cell(err.message)]]);
+	}
+}
+
+async function refreshFailures() {
+	const entries = await api("GET", "/audit?failed=true&n=20");
+	fillTable($("#failures"), entries.map((e) => [cell(new Date(e.Time).toLocaleString()),
+		cell(e.Operation), cell(e.Group), cell(e.Author || e.Identity), cell(e.Status), cell(e.Error)]));
+}
+
+function showAdmin(on) {
+	document.querySelectorAll(".admin").forEach((s) => { s.hidden = !on; });
+	$("#login").hidden = on;
+	$("#logout").hidden = !on;
+}
+
+async function signIn(candidate) {
+	password = candidate;
+	try {
+		await refreshFailures();
+	} catch (err) {
+		password = "";
+		sessionStorage.removeItem("password");
+		showAdmin(false);
+		if (err.status === 403) {
+			alert("Wrong password");
+			return;
+		}
+		throw err;
+	}
+	sessionStorage.setItem("password", password);
+	showAdmin(true);
+}
+
+// runAdmin posts an operation with the admin password as its Author and
+// shows the script output
+async function runAdmin(op, body) {
+	const output = $("#output");
+	output.textContent = "Running " + op + "…";
+	try {
+		const resp = await api("POST", "/" + op, body);
+		output.textContent = resp.Response;
+	} catch (err) {
+		output.textContent = err.message;
+	}
+	refresh();
+}
+
+function refresh() {
+	const tasks = [refreshServer(), refreshGroups()];
+	if (password) {
+		tasks.push(refreshFailures());
+	}
+	return Promise.all(tasks).catch((err) => console.error(err));
+}
+
+$("#login").addEventListener("submit", (ev) => {
+	ev.preventDefault();
+	signIn($("#password").value);
+	$("#password").value = "";
+});
+
+$("#logout").addEventListener("click", () => {
+	password = "";
+	sessionStorage.removeItem("password");
+	showAdmin(false);
+});
+
+$("#creategroup").addEventListener("submit", (ev) => {
+	ev.preventDefault();
+	const form = ev.target;
+	runAdmin("creategroup", {Group: form.Group.value, Author: form.Author.value});
+});
+
+$("#init").addEventListener("submit", (ev) => {
+	ev.preventDefault();
+	const body = {Author: password};
+	if (ev.target.Group.value) {
+		body.Group = ev.target.Group.value;
+	}
+	runAdmin("init", body);
+});
+
+$("#clear").addEventListener("submit", (ev) => {
+	ev.preventDefault();
+	if (confirm("Tear down the network? Every group and commit is lost.")) {
+		runAdmin("clear", {Author: password});
+	}
+});
+
+if (password) {
+	signIn(password);
+}
+refresh();
+setInterval(refresh, refreshInterval);
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp := env.get(t, "/dashboard/")
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "<title>GatherChain dashboard</title>") {
+		t.Fatalf("expected the dashboard page, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Security-Policy") != dashboardPolicy {
+		t.Errorf("expected the content security policy, got %q", resp.Header.Get("Content-Security-Policy"))
+	}
+	for _, file := range []string{"app.js", "style.css"} {
+		if resp := env.get(t, "/dashboard/"+file); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected %s to be served, got %d", file, resp.StatusCode)
+		}
+	}
+	// the client follows the redirect
+	if resp := env.get(t, "/dashboard"); resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/dashboard/" {
+		t.Errorf("expected /dashboard to redirect to /dashboard/, got %d %s", resp.StatusCode, resp.Request.URL.Path)
+	}
+}
+
+func TestDashboardDisabled(t *testing.T) {
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	cfg = defaultConfig()
+	cfg.Dashboard = false
+
+	rec := httptest.NewRecorder()
+	newRouter(newMemoryStore(), &registry{byName: map[string]*operation{}}).ServeHTTP(rec, httptest.NewRequest("GET", "/dashboard/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected no dashboard, got %d", rec.Code)
+	}
+}
+
+func TestListGroups(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("createchannel.sh", scriptResult{Stdout: "Channel created\n"})
+
+	for _, m := range []struct{ group, author string }{{"g2", "bob"}, {"g1", "carol"}, {"g1", "alice"}} {
+		resp := env.post(t, "/creategroup", "", map[string]interface{}{"Author": m.author, "Group": m.group})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected creategroup to succeed, got %d", resp.StatusCode)
+		}
+		resp.Body.Close()
+	}
+
+	var groups []groupInfo
+	json.NewDecoder(env.get(t, "/groups").Body).Decode(&groups)
+	want := []groupInfo{{Name: "g1", Members: []string{"alice", "carol"}}, {Name: "g2", Members: []string{"bob"}}}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("expected %+v, got %+v", want, groups)
+	}
+}
+
+func TestGetAudit(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("test.sh", scriptResult{Stdout: "ok\n"})
+
+	env.post(t, "/test", "r1", map[string]interface{}{"Author": "alice"}).Body.Close()
+	env.post(t, "/clear", "r2", map[string]interface{}{"Author": "not the password"}).Body.Close()
+	env.post(t, "/test", "r3", map[string]interface{}{"Author": "bob"}).Body.Close()
+
+	// audit returns the entries the admin password unlocks
+	audit := func(query, password string) (int, []auditEntry) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", env.srv.URL+"/audit"+query, nil)
+		if password != "" {
+			req.Header.Set(adminPasswordHeader, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var entries []auditEntry
+		json.NewDecoder(resp.Body).Decode(&entries)
+		return resp.StatusCode, entries
+	}
+
+	waitFor(t, "the audit entries", func() bool {
+		_, entries := audit("", env.vm.Password)
+		return len(entries) == 3
+	})
+	if status, _ := audit("", "alice"); status != http.StatusForbidden {
+		t.Errorf("expected a wrong password to be refused, got %d", status)
+	}
+	if status, _ := audit("?n=zero", env.vm.Password); status != http.StatusBadRequest {
+		t.Errorf("expected a bad n to be refused, got %d", status)
+	}
+
+	if _, entries := audit("?n=1", env.vm.Password); len(entries) != 1 || entries[0].RequestID != "r3" {
+		t.Errorf("expected the newest entry, got %+v", entries)
+	}
+	_, entries := audit("?failed=true", env.vm.Password)
+	if len(entries) != 1 || entries[0].RequestID != "r2" || entries[0].Status != http.StatusForbidden {
+		t.Errorf("expected only the refused clear, got %+v", entries)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// event types sent to the group feeds
+const (
+	eventPush           = "push"
+	eventMemberJoined   = "member_joined"
+	eventNetworkCleared = "network_cleared"
+)
+
+// events for a group go through redis on eventsPrefix+group, events for
+// every group (e.g. the network being cleared) on eventsBroadcast, so every
+// replica can forward them to its own subscribers
+const (
+	eventsPrefix    = "events:"
+	eventsBroadcast = "events"
+)
+
+const (
+	// wsWriteWait is the time allowed to write a message to the client
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is the time allowed to read the next pong from the client
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod must be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// groupEvent is what the desktop clients receive on the feed
+type groupEvent struct {
+	Type   string
+	Group  string `json:",omitempty"`
+	Author string `json:",omitempty"`
+	Commit string `json:",omitempty"`
+	Time   time.Time
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkWebSocketOrigin,
+}
+
+// publish sends ev to the subscribers of its group, or to everyone if it
+// has no group. Failing to publish never fails the request that caused it.
+func (uh userHandler) publish(ctx context.Context, ev groupEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	channel := eventsBroadcast
+	if ev.Group != "" {
+		channel = eventsPrefix + ev.Group
+	}
+
+	payload, _ := json.Marshal(ev)
+	if err := uh.store.publish(ctx, channel, payload); err != nil {
+		loggerFrom(ctx).Warn("failed to publish event", "type", ev.Type, "group", ev.Group, "error", err)
+	}
+}
+
+// groupEvents upgrades to a WebSocket and forwards the events of a group
+// until the client goes away. Anything the client sends is ignored.
+func (uh userHandler) groupEvents(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["Group"]
+
+	// subscribe before upgrading so a redis failure is still a plain http error
+	sub, err := uh.store.subscribe(r.Context(), eventsPrefix+group, eventsBroadcast)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer sub.Close()
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an error
+		return
+	}
+	defer ws.Close()
+
+	// the read loop only handles control frames and notices the client leaving
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case payload, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := ws.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
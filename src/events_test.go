@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestGroupEvents(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("createchannel.sh", scriptResult{Stdout: "Channel created\n"})
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+
+	// the route only answers once its subscription is active
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(env.srv.URL, "http")+"/events/g1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	for _, req := range []struct {
+		path string
+		body map[string]interface{}
+	}{
+		{"/creategroup", map[string]interface{}{"Author": "alice", "Group": "g1"}},
+		{"/creategroup", map[string]interface{}{"Author": "bob", "Group": "g2"}},
+		{"/push", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"}},
+		{"/clear", map[string]interface{}{"Author": env.vm.Password}},
+	} {
+		resp := env.post(t, req.path, "", req.body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected success, got %d", req.path, resp.StatusCode)
+		}
+	}
+
+	// the other group is not heard of, the network being cleared is
+	want := []groupEvent{
+		{Type: eventMemberJoined, Group: "g1", Author: "alice"},
+		{Type: eventPush, Group: "g1", Author: "alice", Commit: "abc123"},
+		{Type: eventNetworkCleared},
+	}
+	for _, w := range want {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var ev groupEvent
+		if err := ws.ReadJSON(&ev); err != nil {
+			t.Fatalf("expected %s, got %v", w.Type, err)
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("expected %s to be timed", ev.Type)
+		}
+		ev.Time = time.Time{}
+		if ev != w {
+			t.Errorf("expected %+v, got %+v", w, ev)
+		}
+	}
+}
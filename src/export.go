@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// export formats, chosen with the format parameter or the Accept header
+const (
+	exportCSV    = "csv"
+	exportNDJSON = "ndjson"
+	exportJSON   = "json"
+)
+
+// studentNumberField is the field of a user, as sent to /registernumber,
+// holding their student number
+const studentNumberField = "StudentNumber"
+
+// exportTypes are the content types of the export formats
+var exportTypes = map[string]string{
+	exportCSV:    "text/csv; charset=utf-8",
+	exportNDJSON: "application/x-ndjson",
+	exportJSON:   "application/json",
+}
+
+// exportMediaTypes maps the media types a client may accept to a format
+var exportMediaTypes = map[string]string{
+	"text/csv":             exportCSV,
+	"application/x-ndjson": exportNDJSON,
+	"application/ndjson":   exportNDJSON,
+	"application/jsonl":    exportNDJSON,
+	"application/json":     exportJSON,
+}
+
+// a group whose history can't be read because another script holds the
+// network is tried again every exportRetryDelay, for up to exportLockWait.
+// Once an export started streaming a busy network can't be reported
+// anymore, it would cut the export short.
+const (
+	exportRetryDelay = 200 * time.Millisecond
+	exportLockWait   = time.Minute
+)
+
+// exportColumns is the header row of a CSV export
+var exportColumns = []string{
+	"Group", "Commit", "Author", "StudentNumber", "Timestamp", "TxId",
+	"Message", "ClientVersion", "ClientTimestamp", "Received", "Artifacts", "SignedBy",
+}
+
+// exportRecord is a push in an export, the history entry with the student
+// number of its author
+type exportRecord struct {
+	Group         string
+	Commit        string
+	Author        string
+	StudentNumber string `json:",omitempty"`
+	Timestamp     string
+	TxID          string          `json:"TxId"`
+	Metadata      *commitMetadata `json:",omitempty"`
+}
+
+// exportFormat returns the format asked for by r, the format parameter
+// first then the Accept header, json when neither says. The status tells
+// why there is none.
+func exportFormat(r *http.Request) (string, int) {
+	if f := strings.ToLower(r.URL.Query().Get("format")); f != "" {
+		if f == "jsonl" {
+			f = exportNDJSON
+		}
+		if _, ok := exportTypes[f]; !ok {
+			return "", http.StatusBadRequest
+		}
+		return f, 0
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return exportJSON, 0
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if f, ok := exportMediaTypes[mt]; ok {
+			return f, 0
+		}
+		if mt == "*/*" || mt == "application/*" {
+			return exportJSON, 0
+		}
+		if mt == "text/*" {
+			return exportCSV, 0
+		}
+	}
+	return "", http.StatusNotAcceptable
+}
+
+// exportWriter writes the records of an export in one format
+type exportWriter interface {
+	write(rec exportRecord) error
+	// close ends the export, it is complete once close returns
+	close() error
+}
+
+func newExportWriter(format string, w io.Writer) exportWriter {
+	switch format {
+	case exportCSV:
+		return &csvExport{w: csv.NewWriter(w)}
+	case exportNDJSON:
+		return ndjsonExport{json.NewEncoder(w)}
+	}
+	return &jsonExport{w: w}
+}
+
+// csvExport writes a header row then a row per push, the metadata in
+// columns
+type csvExport struct {
+	w       *csv.Writer
+	started bool
+}
+
+// spreadsheetSafe keeps a spreadsheet from taking a cell that looks like a
+// formula for one
+func spreadsheetSafe(s string) string {
+	if s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+		return "'" + s
+	}
+	return s
+}
+
+func (ce *csvExport) write(rec exportRecord) error {
+	if !ce.started {
+		ce.started = true
+		if err := ce.w.Write(exportColumns); err != nil {
+			return err
+		}
+	}
+	row := []string{rec.Group, rec.Commit, rec.Author, rec.StudentNumber, rec.Timestamp, rec.TxID, "", "", "", "", "", ""}
+	if m := rec.Metadata; m != nil {
+		artifacts := make([]string, len(m.Artifacts))
+		for i, a := range m.Artifacts {
+			artifacts[i] = a.Path + "=" + a.Hash
+		}
+		row[6], row[7], row[8], row[10] = m.Message, m.ClientVersion, m.Timestamp, strings.Join(artifacts, "; ")
+		if !m.Received.IsZero() {
+			row[9] = m.Received.Format(time.RFC3339)
+		}
+		if m.Signed != nil {
+			row[11] = m.Signed.Key
+		}
+	}
+	for i := range row {
+		row[i] = spreadsheetSafe(row[i])
+	}
+	if err := ce.w.Write(row); err != nil {
+		return err
+	}
+	// a row at a time, the export streams
+	ce.w.Flush()
+	return ce.w.Error()
+}
+
+func (ce *csvExport) close() error {
+	if !ce.started {
+		ce.started = true
+		ce.w.Write(exportColumns)
+	}
+	ce.w.Flush()
+	return ce.w.Error()
+}
+
+// ndjsonExport writes a json object per line
+type ndjsonExport struct {
+	enc *json.Encoder
+}
+
+func (ne ndjsonExport) write(rec exportRecord) error {
+	return ne.enc.Encode(rec)
+}
+
+func (ne ndjsonExport) close() error {
+	return nil
+}
+
+// jsonExport writes a single json array, an element at a time
+type jsonExport struct {
+	w     io.Writer
+	count int
+}
+
+func (je *jsonExport) write(rec exportRecord) error {
+	sep := ",\n"
+	if je.count == 0 {
+		sep = "[\n"
+	}
+	je.count++
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(je.w, sep+string(data))
+	return err
+}
+
+func (je *jsonExport) close() error {
+	end := "\n]\n"
+	if je.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(je.w, end)
+	return err
+}
+
+// studentNumbers returns the student numbers of authors, looked up once each
+type studentNumbers struct {
+	st   store
+	seen map[string]string
+}
+
+func (sn *studentNumbers) of(ctx context.Context, author string) (string, error) {
+	if n, ok := sn.seen[author]; ok {
+		return n, nil
+	}
+	info, err := sn.st.user(ctx, author)
+	if err != nil {
+		return "", err
+	}
+	sn.seen[author] = info[studentNumberField]
+	return sn.seen[author], nil
+}
+
+// historyWaiting reads the history of group like historyOf, waiting for
+// the network while another script holds it
+func (oh opHandler) historyWaiting(ctx context.Context, w http.ResponseWriter, history *operation, group string) ([]historyEntry, error) {
+	deadline := time.Now().Add(exportLockWait)
+	for {
+		entries, err := oh.historyOf(ctx, w, history, group)
+		if err != errNetworkBusy || time.Now().After(deadline) {
+			return entries, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(exportRetryDelay):
+		}
+	}
+}
+
+// exportHistory streams the history of a group, or of every group, for
+// grading. Each group is read from the chain in turn, waiting for the
+// network when it is busy, and written out before the next one.
+func (oh opHandler) exportHistory(history *operation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminRequest(r) {
+			http.Error(w, "Wrong Password", http.StatusForbidden)
+			return
+		}
+		if history == nil {
+			http.Error(w, "No history operation to export from", http.StatusNotImplemented)
+			return
+		}
+		format, status := exportFormat(r)
+		if status != 0 {
+			http.Error(w, "format must be csv, ndjson or json", status)
+			return
+		}
+
+		ctx := r.Context()
+		groups := []string{mux.Vars(r)["Group"]}
+		name := groups[0]
+		if groups[0] == "" {
+			var err error
+			if groups, err = oh.uh.store.groups(ctx); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			name = "all"
+		}
+
+		numbers := &studentNumbers{st: oh.uh.store, seen: map[string]string{}}
+		flusher, _ := w.(http.Flusher)
+		var out exportWriter
+		for _, group := range groups {
+			entries, err := oh.historyWaiting(ctx, w, history, group)
+			if err == nil {
+				err = oh.uh.attachMetadata(ctx, group, entries)
+			}
+			if err != nil {
+				if out == nil {
+					writeScriptError(w, err)
+					return
+				}
+				// the status is sent, break the response so the client
+				// can't take the export for complete
+				loggerFrom(ctx).Error("export cut short", "group", group, "error", err)
+				panic(http.ErrAbortHandler)
+			}
+
+			if out == nil {
+				w.Header().Set("Content-Type", exportTypes[format])
+				w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": "history-" + name + "." + format}))
+				w.Header().Set("X-Accel-Buffering", "no")
+				out = newExportWriter(format, w)
+			}
+			for _, e := range entries {
+				number, err := numbers.of(ctx, e.Author)
+				if err != nil {
+					loggerFrom(ctx).Warn("can't read the student number", "author", e.Author, "error", err)
+				}
+				rec := exportRecord{
+					Group: group, Commit: e.Commit, Author: e.Author, StudentNumber: number,
+					Timestamp: e.Timestamp, TxID: e.TxID, Metadata: e.Metadata,
+				}
+				if err := out.write(rec); err != nil {
+					// the client went away
+					return
+				}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if out == nil {
+			w.Header().Set("Content-Type", exportTypes[format])
+			out = newExportWriter(format, w)
+		}
+		out.close()
+	}
+}
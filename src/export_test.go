@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportFormat(t *testing.T) {
+	for _, tc := range []struct {
+		query, accept string
+		format        string
+		status        int
+	}{
+		{"", "", exportJSON, 0},
+		{"?format=CSV", "application/json", exportCSV, 0},
+		{"?format=jsonl", "", exportNDJSON, 0},
+		{"?format=xlsx", "", "", http.StatusBadRequest},
+		{"", "text/csv;q=0.9, application/json", exportCSV, 0},
+		{"", "application/x-ndjson", exportNDJSON, 0},
+		{"", "*/*", exportJSON, 0},
+		{"", "text/*", exportCSV, 0},
+		{"", "image/png", "", http.StatusNotAcceptable},
+	} {
+		r, _ := http.NewRequest("GET", "/export"+tc.query, nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+		if format, status := exportFormat(r); format != tc.format || status != tc.status {
+			t.Errorf("%q %q: expected %q %d, got %q %d", tc.query, tc.accept, tc.format, tc.status, format, status)
+		}
+	}
+}
+
+func TestExportHistory(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("createchannel.sh", scriptResult{Stdout: "Channel created\n"})
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+	history := `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "alice", "Commit": "abc123"},
+		{"TxId": "tx2", "Timestamp": "2021-03-01T11:00:00Z", "Author": "bob", "Commit": "def456"}]`
+	env.vm.script("gethistory.sh", scriptResult{Stdout: history + "\n"})
+
+	for _, g := range []string{"g2", "g1"} {
+		env.post(t, "/creategroup", "", map[string]interface{}{"Author": "alice", "Group": g}).Body.Close()
+	}
+	env.post(t, "/registernumber", "", map[string]interface{}{"Author": "alice", studentNumberField: "s1234567"}).Body.Close()
+	env.post(t, "/push", "", map[string]interface{}{
+		"Author": "alice", "Group": "g1", "Commit": "abc123",
+		"Message":   "=HYPERLINK(\"x\")",
+		"Artifacts": []artifact{{Path: "main.go", Hash: "00ff"}, {Path: "go.mod", Hash: "11ee"}},
+	}).Body.Close()
+
+	// export returns the answer to an admin export
+	export := func(path, accept string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", env.srv.URL+path, nil)
+		req.Header.Set(adminPasswordHeader, env.vm.Password)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := export("/groups/g1/export?format=csv", "")
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") ||
+		!strings.Contains(resp.Header.Get("Content-Disposition"), "history-g1.csv") {
+		t.Fatalf("expected a csv attachment, got %d %v", resp.StatusCode, resp.Header)
+	}
+	rows, err := csv.NewReader(resp.Body).ReadAll()
+	resp.Body.Close()
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %q %v", rows, err)
+	}
+	want := []string{"g1", "abc123", "alice", "s1234567", "2021-03-01T10:00:00Z", "tx1", "'=HYPERLINK(\"x\")", "", "", rows[1][9], "main.go=00ff; go.mod=11ee", ""}
+	if strings.Join(rows[0], ",") != strings.Join(exportColumns, ",") || strings.Join(rows[1], "|") != strings.Join(want, "|") || rows[1][9] == "" {
+		t.Errorf("expected %q, got %q", want, rows[:2])
+	}
+	if rows[2][2] != "bob" || rows[2][3] != "" || rows[2][6] != "" {
+		t.Errorf("expected bob without metadata, got %q", rows[2])
+	}
+
+	// every group, one record per line
+	resp = export("/export", "application/x-ndjson")
+	var recs []exportRecord
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var rec exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("expected a json line, got %q: %v", scanner.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	resp.Body.Close()
+	if len(recs) != 4 || recs[0].Group != "g1" || recs[2].Group != "g2" || recs[0].Metadata == nil || recs[2].Metadata != nil {
+		t.Fatalf("expected g1 then g2, metadata on g1 only, got %+v", recs)
+	}
+
+	resp = export("/export", "")
+	recs = nil
+	err = json.NewDecoder(resp.Body).Decode(&recs)
+	resp.Body.Close()
+	if err != nil || len(recs) != 4 || recs[1].TxID != "tx2" {
+		t.Errorf("expected a json array of 4 records, got %+v %v", recs, err)
+	}
+
+	for _, tc := range []struct {
+		path, accept string
+		status       int
+	}{
+		{"/export?format=xml", "", http.StatusBadRequest},
+		{"/export", "image/png", http.StatusNotAcceptable},
+	} {
+		resp := export(tc.path, tc.accept)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s: expected %d, got %d", tc.path, tc.accept, tc.status, resp.StatusCode)
+		}
+	}
+	if resp := env.get(t, "/export"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the export to need the admin password, got %d", resp.StatusCode)
+	}
+}
+
+func TestExportWaitsForTheNetwork(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("createchannel.sh", scriptResult{Stdout: "Channel created\n"})
+	env.vm.script("gethistory.sh", scriptResult{Stdout: `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "alice", "Commit": "abc123"}]` + "\n"})
+	for _, g := range []string{"g1", "g2", "g3"} {
+		env.post(t, "/creategroup", "", map[string]interface{}{"Author": "alice", "Group": g}).Body.Close()
+	}
+
+	// another script holds the network for a while
+	release, ok := locks.tryLock(lockGlobal, "")
+	if !ok {
+		t.Fatal("expected the lock to be free")
+	}
+	time.AfterFunc(3*exportRetryDelay, release)
+
+	req, _ := http.NewRequest("GET", env.srv.URL+"/export?format=ndjson", nil)
+	req.Header.Set(adminPasswordHeader, env.vm.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || strings.Count(body, "\n") != 3 {
+		t.Errorf("expected a record for each group, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	env := newTestEnv(t)
+	req, _ := http.NewRequest("GET", env.srv.URL+"/export", nil)
+	req.Header.Set(adminPasswordHeader, env.vm.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "[]\n" {
+		t.Errorf("expected an empty array, got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kinds of indexed hashes
+const (
+	hashCommit   = "commit"
+	hashArtifact = "artifact"
+)
+
+const (
+	// minHashPrefix keeps a search from listing the whole index
+	minHashPrefix = 4
+	// defaultHashPage and maxHashPage bound the hashes a search or report
+	// returns
+	defaultHashPage = 50
+	maxHashPage     = 500
+)
+
+// hashPrefixPattern is what a search may look for
+var hashPrefixPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// hashOccurrence is a place a hash was pushed: as a commit, or as the
+// content of an artifact of a commit
+type hashOccurrence struct {
+	Kind   string
+	Group  string
+	Commit string
+	Path   string `json:",omitempty"`
+	Author string `json:",omitempty"`
+}
+
+// hashMatch is a hash and everywhere it was pushed
+type hashMatch struct {
+	Hash        string
+	Occurrences []hashOccurrence
+}
+
+// groups returns how many groups m was pushed to
+func (m hashMatch) groups() int {
+	seen := map[string]bool{}
+	for _, o := range m.Occurrences {
+		seen[o.Group] = true
+	}
+	return len(seen)
+}
+
+// pushOccurrences returns the hashes of a push by hash: its commit, if it
+// is one, and the content of its artifacts
+func pushOccurrences(cp ContentPost) map[string][]hashOccurrence {
+	occs := map[string][]hashOccurrence{}
+	if commit := strings.ToLower(cp.Commit); argTypes["hash"].MatchString(commit) {
+		occs[commit] = append(occs[commit], hashOccurrence{Kind: hashCommit, Group: cp.Group, Commit: cp.Commit, Author: cp.Author})
+	}
+	if cp.Metadata != nil {
+		for _, a := range cp.Metadata.Artifacts {
+			h := strings.ToLower(a.Hash)
+			occs[h] = append(occs[h], hashOccurrence{Kind: hashArtifact, Group: cp.Group, Commit: cp.Commit, Path: a.Path, Author: cp.Author})
+		}
+	}
+	return occs
+}
+
+// indexPushHashes adds the hashes of a successful push to the index shared
+// by every group
+func (uh userHandler) indexPushHashes(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	if err := uh.store.indexHashes(ctx, pushOccurrences(cp)); err != nil {
+		loggerFrom(ctx).Warn("failed to index hashes", "group", cp.Group, "commit", cp.Commit, "error", err)
+	}
+}
+
+// indexHistoryHashes adds the commits of a history to the index shared by
+// every group, for those pushed before it existed
+func (uh userHandler) indexHistoryHashes(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	entries, ok := resp.Result.([]historyEntry)
+	if !ok {
+		return
+	}
+	occs := map[string][]hashOccurrence{}
+	for _, e := range entries {
+		if commit := strings.ToLower(e.Commit); argTypes["hash"].MatchString(commit) {
+			occs[commit] = append(occs[commit], hashOccurrence{Kind: hashCommit, Group: cp.Group, Commit: e.Commit, Author: e.Author})
+		}
+	}
+	if err := uh.store.indexHashes(ctx, occs); err != nil {
+		loggerFrom(ctx).Warn("failed to index hashes", "group", cp.Group, "error", err)
+	}
+}
+
+// hashPage reads the limit parameter of r
+func hashPage(r *http.Request) (int, bool) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return defaultHashPage, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	if n > maxHashPage {
+		n = maxHashPage
+	}
+	return n, true
+}
+
+// sortOccurrences orders occs by group, commit, kind and path
+func sortOccurrences(occs []hashOccurrence) {
+	sort.Slice(occs, func(i, j int) bool {
+		a, b := occs[i], occs[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Commit != b.Commit {
+			return a.Commit < b.Commit
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Path < b.Path
+	})
+}
+
+// writeMatches answers with matches
+func writeMatches(w http.ResponseWriter, matches []hashMatch) {
+	if matches == nil {
+		matches = []hashMatch{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches)
+}
+
+// hashKind reads the kind parameter of r, empty for every kind
+func hashKind(r *http.Request) (string, bool) {
+	kind := r.URL.Query().Get("kind")
+	return kind, kind == "" || kind == hashCommit || kind == hashArtifact
+}
+
+// searchHashes finds the commits and artifacts whose hash starts with the
+// hash parameter, in every group
+func (uh userHandler) searchHashes(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Wrong Password", http.StatusForbidden)
+		return
+	}
+	prefix := strings.ToLower(r.URL.Query().Get("hash"))
+	if len(prefix) < minHashPrefix || !hashPrefixPattern.MatchString(prefix) {
+		http.Error(w, "hash must be at least "+strconv.Itoa(minHashPrefix)+" hex digits", http.StatusBadRequest)
+		return
+	}
+	limit, ok := hashPage(r)
+	if !ok {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+	kind, ok := hashKind(r)
+	if !ok {
+		http.Error(w, "kind must be commit or artifact", http.StatusBadRequest)
+		return
+	}
+
+	matches, err := uh.store.searchHashes(r.Context(), prefix, kind, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeMatches(w, matches)
+}
+
+// getDuplicates reports the hashes pushed to more than one group, identical
+// artifacts from different groups being a sign of plagiarism
+func (uh userHandler) getDuplicates(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Wrong Password", http.StatusForbidden)
+		return
+	}
+	limit, ok := hashPage(r)
+	if !ok {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+	kind, ok := hashKind(r)
+	if !ok {
+		http.Error(w, "kind must be commit or artifact", http.StatusBadRequest)
+		return
+	}
+
+	matches, err := uh.store.sharedHashes(r.Context(), kind, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeMatches(w, matches)
+}
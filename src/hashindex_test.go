@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHashSearchAndDuplicates(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+
+	push := func(author, group, commit string, artifacts ...artifact) {
+		t.Helper()
+		resp := env.post(t, "/push", "", map[string]interface{}{"Author": author, "Group": group, "Commit": commit, "Artifacts": artifacts})
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the push of %s to succeed, got %d", commit, resp.StatusCode)
+		}
+	}
+	push("alice", "g1", "abc123", artifact{Path: "src/main.go", Hash: "00FF11"}, artifact{Path: "README", Hash: "beef01"})
+	push("bob", "g2", "def456", artifact{Path: "main.go", Hash: "00ff11"})
+	push("carol", "g2", "abc123")
+
+	// matches returns the answer of an admin query
+	matches := func(path, password string) (int, []hashMatch) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", env.srv.URL+path, nil)
+		if password != "" {
+			req.Header.Set(adminPasswordHeader, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var found []hashMatch
+		json.NewDecoder(resp.Body).Decode(&found)
+		return resp.StatusCode, found
+	}
+
+	status, found := matches("/search?hash=00FF", env.vm.Password)
+	if status != http.StatusOK || len(found) != 1 || found[0].Hash != "00ff11" || found[0].groups() != 2 {
+		t.Fatalf("expected 00ff11 in both groups, got %d %+v", status, found)
+	}
+	if o := found[0].Occurrences[1]; o.Kind != hashArtifact || o.Group != "g2" || o.Commit != "def456" || o.Path != "main.go" || o.Author != "bob" {
+		t.Errorf("expected the artifact of bob, got %+v", o)
+	}
+	if _, found = matches("/search?hash=abc123", env.vm.Password); len(found) != 1 || len(found[0].Occurrences) != 2 {
+		t.Errorf("expected the commit abc123 in both groups, got %+v", found)
+	}
+
+	status, found = matches("/duplicates", env.vm.Password)
+	if status != http.StatusOK || len(found) != 2 || found[0].Hash != "00ff11" || found[1].Hash != "abc123" {
+		t.Fatalf("expected 00ff11 and abc123, got %d %+v", status, found)
+	}
+	if _, found = matches("/duplicates?kind=artifact", env.vm.Password); len(found) != 1 || found[0].Hash != "00ff11" {
+		t.Errorf("expected the shared artifact only, got %+v", found)
+	}
+	if _, found = matches("/duplicates?limit=1", env.vm.Password); len(found) != 1 {
+		t.Errorf("expected one hash, got %+v", found)
+	}
+	// the artifact sorts first, the limit counts commits only
+	if _, found = matches("/duplicates?kind=commit&limit=1", env.vm.Password); len(found) != 1 || found[0].Hash != "abc123" {
+		t.Errorf("expected the shared commit, got %+v", found)
+	}
+
+	for _, tc := range []struct {
+		path, password string
+		status         int
+	}{
+		{"/search?hash=00ff", "alice", http.StatusForbidden},
+		{"/duplicates", "", http.StatusForbidden},
+		{"/search?hash=00f", env.vm.Password, http.StatusBadRequest},
+		{"/search?hash=zzzz", env.vm.Password, http.StatusBadRequest},
+		{"/duplicates?limit=0", env.vm.Password, http.StatusBadRequest},
+		{"/duplicates?kind=tag", env.vm.Password, http.StatusBadRequest},
+	} {
+		if status, _ := matches(tc.path, tc.password); status != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.status, status)
+		}
+	}
+}
+
+func TestHistoryIndexesHashes(t *testing.T) {
+	env := newTestEnv(t)
+	history := `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "bob", "Group": "g1", "Commit": "def456"}]`
+	env.vm.script("gethistory.sh", scriptResult{Stdout: history + "\n"})
+
+	env.post(t, "/history", "", map[string]interface{}{"Author": "alice", "Group": "g1"}).Body.Close()
+	found, err := env.store.searchHashes(context.Background(), "def456", "", 10)
+	if err != nil || len(found) != 1 || found[0].Occurrences[0] != (hashOccurrence{Kind: hashCommit, Group: "g1", Commit: "def456", Author: "bob"}) {
+		t.Errorf("expected the commit of the history, got %+v %v", found, err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// probeTimeout bounds each individual readiness check
+const probeTimeout = 3 * time.Second
+
+// checkResult is the outcome of a single readiness check
+type checkResult struct {
+	Status    string
+	LatencyMs int64
+	Error     string `json:",omitempty"`
+}
+
+// readinessReport is the json body returned by /readyz
+type readinessReport struct {
+	Status string
+	Checks map[string]checkResult
+	Locked bool
+	Locks  lockState
+}
+
+type healthHandler struct {
+	store store
+}
+
+// liveness only tells the orchestrator that the process is up and serving
+func (hh healthHandler) liveness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"Status": "ok"})
+}
+
+// readiness checks every dependency a request needs: the store and the backend,
+// the VM over ssh and its bloc-server scripts unless simulated. The lock is
+// reported but does not fail the probe, a long running init should not take
+// the instance out of rotation.
+// An instance shutting down is never ready.
+func (hh healthHandler) readiness(w http.ResponseWriter, r *http.Request) {
+	report := readinessReport{
+		Status: "ready",
+		Checks: map[string]checkResult{},
+		Locks:  locks.state(),
+	}
+
+	report.Locked = report.Locks.Global || len(report.Locks.Groups) > 0
+
+	hh.store.ready(r.Context(), report.Checks)
+	vm.ready(r.Context(), report.Checks)
+
+	for _, c := range report.Checks {
+		if c.Status != "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	if atomic.LoadUint32(&draining) == 1 {
+		report.Status = "draining"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// ready checks the VM can be reached and logged into over ssh, and has the
+// bloc-server scripts
+func (sshBackend) ready(ctx context.Context, checks map[string]checkResult) {
+	var conn net.Conn
+	checks["ssh"] = timed(func() error {
+		var err error
+		conn, err = net.DialTimeout("tcp", cfg.vmAddr(), probeTimeout)
+		return err
+	})
+
+	var client *ssh.Client
+	if conn != nil {
+		defer conn.Close()
+		checks["ssh_auth"] = timed(func() error {
+			conn.SetDeadline(time.Now().Add(probeTimeout))
+			c, chans, reqs, err := ssh.NewClientConn(conn, cfg.vmAddr(), sshClientConfig())
+			if err != nil {
+				return err
+			}
+			client = ssh.NewClient(c, chans, reqs)
+			return nil
+		})
+	} else {
+		checks["ssh_auth"] = skipped()
+	}
+
+	if client != nil {
+		defer client.Close()
+		checks["scripts_dir"] = timed(func() error {
+			sess, err := client.NewSession()
+			if err != nil {
+				return err
+			}
+			defer sess.Close()
+			return sess.Run("test -d " + shellQuote(cfg.ScriptsDir))
+		})
+	} else {
+		checks["scripts_dir"] = skipped()
+	}
+}
+
+// timed runs a check and records how long it took
+func timed(check func() error) checkResult {
+	start := time.Now()
+	err := check()
+	res := checkResult{Status: "ok", LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Status = "failed"
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// skipped marks a check that could not run because an earlier one failed
+func skipped() checkResult {
+	return checkResult{Status: "skipped"}
+}
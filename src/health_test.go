@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestLiveness(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthHandler{}.liveness(rec, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestReadinessReportsUnreachableDependencies(t *testing.T) {
+	oldCfg := cfg
+	cfg = defaultConfig()
+	cfg.VMHost, cfg.VMPort = "127.0.0.1", 1
+	defer func() { cfg = oldCfg }()
+
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer client.Close()
+
+	rec := httptest.NewRecorder()
+	healthHandler{store: newRedisStore(client)}.readiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+
+	var report readinessReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"redis", "ssh"} {
+		if report.Checks[name].Status != "failed" {
+			t.Errorf("expected %s check to fail, got %+v", name, report.Checks[name])
+		}
+	}
+	for _, name := range []string{"ssh_auth", "scripts_dir"} {
+		if report.Checks[name].Status != "skipped" {
+			t.Errorf("expected %s check to be skipped, got %+v", name, report.Checks[name])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyEntry is one push recorded on the chain for a group
+type historyEntry struct {
+	TxID      string `json:"TxId"`
+	Timestamp string
+	Author    string
+	Group     string
+	Commit    string
+	// Metadata is what the client sent with the push, when it did
+	Metadata *commitMetadata `json:",omitempty"`
+}
+
+// errNoHistory is returned when the output holds no json array
+var errNoHistory = errors.New("no history found in script output")
+
+// parseHistory reads the output of gethistory.sh. The peer prints a json
+// array after its log lines, each record either flat or, as returned by
+// GetHistoryForKey, with the pushed value under "Value" (possibly as a json
+// string) and a protobuf timestamp.
+func parseHistory(output string) ([]historyEntry, error) {
+	start, offset := -1, 0
+	for _, line := range strings.SplitAfter(output, "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if strings.HasPrefix(trimmed, "[") {
+			start = offset + len(line) - len(trimmed)
+			break
+		}
+		offset += len(line)
+	}
+	if start < 0 {
+		return nil, errNoHistory
+	}
+
+	var records []map[string]interface{}
+	if err := json.NewDecoder(strings.NewReader(output[start:])).Decode(&records); err != nil {
+		return nil, err
+	}
+
+	entries := make([]historyEntry, 0, len(records))
+	for _, rec := range records {
+		fields := map[string]interface{}{}
+		for k, v := range rec {
+			fields[strings.ToLower(k)] = v
+		}
+		if value, ok := fields["value"]; ok {
+			if s, ok := value.(string); ok {
+				var inner map[string]interface{}
+				if json.Unmarshal([]byte(s), &inner) == nil {
+					value = inner
+				}
+			}
+			if inner, ok := value.(map[string]interface{}); ok {
+				for k, v := range inner {
+					fields[strings.ToLower(k)] = v
+				}
+			}
+		}
+
+		entries = append(entries, historyEntry{
+			TxID:      firstString(fields, "txid", "tx_id"),
+			Timestamp: normalizeTimestamp(fields["timestamp"]),
+			Author:    firstString(fields, "author"),
+			Group:     firstString(fields, "group"),
+			Commit:    firstString(fields, "commit", "hash"),
+		})
+	}
+	return entries, nil
+}
+
+// firstString returns the first of keys holding a string
+func firstString(fields map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if s, ok := fields[k].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// normalizeTimestamp turns the timestamps found in history records, RFC 3339
+// strings, unix seconds or protobuf {seconds, nanos}, into RFC 3339
+func normalizeTimestamp(v interface{}) string {
+	switch ts := v.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+		if secs, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			return time.Unix(secs, 0).UTC().Format(time.RFC3339)
+		}
+		return ts
+	case float64:
+		return time.Unix(int64(ts), 0).UTC().Format(time.RFC3339)
+	case map[string]interface{}:
+		secs, _ := ts["seconds"].(float64)
+		if s, ok := ts["seconds"].(string); ok {
+			n, _ := strconv.ParseFloat(s, 64)
+			secs = n
+		}
+		nanos, _ := ts["nanos"].(float64)
+		return time.Unix(int64(secs), int64(nanos)).UTC().Format(time.RFC3339)
+	}
+	return ""
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// toJSON encodes v for comparisons
+func toJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestParseHistory(t *testing.T) {
+	output := `2021-05-01 12:00:00 querying chaincode
+  [{"TxId":"abc","Timestamp":{"seconds":1619870400,"nanos":0},"IsDelete":false,"Value":"{\"Author\":\"ana\",\"Group\":\"g1\",\"Commit\":\"c0ffee\"}"},
+   {"txId":"def","timestamp":"2021-05-02T10:00:00Z","author":"rui","group":"g1","commit":"beef"}]
+`
+	entries, err := parseHistory(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []historyEntry{
+		{TxID: "abc", Timestamp: "2021-05-01T12:00:00Z", Author: "ana", Group: "g1", Commit: "c0ffee"},
+		{TxID: "def", Timestamp: "2021-05-02T10:00:00Z", Author: "rui", Group: "g1", Commit: "beef"},
+	}
+	if toJSON(t, entries) != toJSON(t, want) {
+		t.Errorf("expected %+v, got %+v", want, entries)
+	}
+
+	if _, err := parseHistory("no records for this group\n"); err != errNoHistory {
+		t.Errorf("expected errNoHistory, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jobPrefix = "job:"
+
+// job states
+const (
+	jobRunning     = "running"
+	jobDone        = "done"
+	jobFailed      = "failed"
+	jobInterrupted = "interrupted"
+)
+
+// maxJobLines bounds the output kept per job, older lines are dropped
+const maxJobLines = 10000
+
+// keptJobs is how many finished jobs stay available for /jobs
+const keptJobs = 50
+
+// jobLine is one line of output of a remote script
+type jobLine struct {
+	Stream string
+	Text   string
+}
+
+// job is one remote script execution
+type job struct {
+	ID        string
+	Script    string
+	RequestID string
+	Started   time.Time
+	// Role is the role of the operation that ran the script, the output of
+	// admin operations is for admins only
+	Role string
+
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	state   string
+	lines   []jobLine
+	dropped int
+	changed chan struct{}
+	// status and answer are what the operation answered, kept when the
+	// client did not wait for it
+	status int
+	answer string
+}
+
+// jobInfo is the json view of a job
+type jobInfo struct {
+	ID        string
+	Script    string
+	RequestID string `json:",omitempty"`
+	Role      string
+	State     string
+	Started   time.Time
+	// Status and Answer are the answer of an operation run with
+	// "Prefer: respond-async", once it is over
+	Status int    `json:",omitempty"`
+	Answer string `json:",omitempty"`
+}
+
+// jobRegistry keeps track of the scripts running on the VM so their output
+// can be followed and they can be waited for, or cut off, on shutdown
+type jobRegistry struct {
+	mu       sync.Mutex
+	running  map[string]*job
+	finished []*job
+	wg       sync.WaitGroup
+}
+
+var jobs = &jobRegistry{running: map[string]*job{}}
+
+// newJobID returns a random identifier for a job
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// start registers a new job running script. Its arguments are not kept,
+// they may carry the admin password. The returned context is cancelled when
+// the job is interrupted.
+func (jr *jobRegistry) start(ctx context.Context, script, role string) (*job, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	j := &job{
+		ID:        newJobID(),
+		Script:    script,
+		Role:      role,
+		RequestID: requestID(ctx),
+		Started:   time.Now(),
+		cancel:    cancel,
+		state:     jobRunning,
+		changed:   make(chan struct{}),
+	}
+
+	jr.mu.Lock()
+	jr.running[j.ID] = j
+	jr.mu.Unlock()
+	jr.wg.Add(1)
+	return j, ctx
+}
+
+// finish marks j as no longer running
+func (jr *jobRegistry) finish(j *job, err error) {
+	j.mu.Lock()
+	switch {
+	case j.state == jobInterrupted:
+	case err != nil:
+		j.state = jobFailed
+	default:
+		j.state = jobDone
+	}
+	j.notify()
+	j.mu.Unlock()
+
+	jr.mu.Lock()
+	delete(jr.running, j.ID)
+	jr.finished = append(jr.finished, j)
+	if len(jr.finished) > keptJobs {
+		jr.finished = jr.finished[len(jr.finished)-keptJobs:]
+	}
+	jr.mu.Unlock()
+
+	j.cancel()
+	jr.wg.Done()
+}
+
+// get returns the running or recently finished job with id
+func (jr *jobRegistry) get(id string) *job {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	if j, ok := jr.running[id]; ok {
+		return j
+	}
+	for _, j := range jr.finished {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// list returns the running jobs followed by the recently finished ones,
+// newest first
+func (jr *jobRegistry) list() []jobInfo {
+	jr.mu.Lock()
+	all := make([]*job, 0, len(jr.running)+len(jr.finished))
+	for _, j := range jr.running {
+		all = append(all, j)
+	}
+	for i := len(jr.finished) - 1; i >= 0; i-- {
+		all = append(all, jr.finished[i])
+	}
+	jr.mu.Unlock()
+
+	infos := make([]jobInfo, len(all))
+	for i, j := range all {
+		infos[i] = j.info()
+	}
+	return infos
+}
+
+// wait blocks until every running job finished or ctx is done
+func (jr *jobRegistry) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jr.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// interrupt persists the jobs that are still running so an operator can
+// check the VM state after a restart, then cancels them
+func (jr *jobRegistry) interrupt(ctx context.Context, st store) error {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	var firstErr error
+	for _, j := range jr.running {
+		j.mu.Lock()
+		j.state = jobInterrupted
+		j.mu.Unlock()
+
+		err := st.saveJob(ctx, j.info())
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		j.cancel()
+	}
+	return firstErr
+}
+
+// info returns a snapshot of the job
+func (j *job) info() jobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return jobInfo{ID: j.ID, Script: j.Script, RequestID: j.RequestID, Role: j.Role, State: j.state, Started: j.Started, Status: j.status, Answer: j.answer}
+}
+
+// setAnswer keeps the answer of the operation that ran j
+func (j *job) setAnswer(status int, answer string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status, j.answer = status, answer
+	j.notify()
+}
+
+// notify wakes up everyone following the job, j.mu must be held
+func (j *job) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// appendLine adds one line of output
+func (j *job) appendLine(stream, text string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.lines = append(j.lines, jobLine{Stream: stream, Text: text})
+	if len(j.lines) > maxJobLines {
+		j.lines = j.lines[1:]
+		j.dropped++
+	}
+	j.notify()
+}
+
+// follow returns the lines after offset (counted from the first line ever
+// written), the new offset, whether the job is over and a channel closed on
+// the next change
+func (j *job) follow(offset int) ([]jobLine, int, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	// the offset comes from the client, it may be anything
+	start := offset - j.dropped
+	if start < 0 {
+		start = 0
+	}
+	if start > len(j.lines) {
+		start = len(j.lines)
+	}
+	lines := append([]jobLine(nil), j.lines[start:]...)
+	return lines, j.dropped + len(j.lines), j.state != jobRunning, j.changed
+}
+
+// output returns a writer that feeds the job line by line from stream
+func (j *job) output(stream string) *lineWriter {
+	return &lineWriter{j: j, stream: stream}
+}
+
+// lineWriter splits what a session writes into lines for the job
+type lineWriter struct {
+	j      *job
+	stream string
+	buf    bytes.Buffer
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf.Write(p)
+	for {
+		i := bytes.IndexByte(lw.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(lw.buf.Next(i + 1))
+		lw.j.appendLine(lw.stream, strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+// flush hands over a last line without a trailing newline
+func (lw *lineWriter) flush() {
+	if lw.buf.Len() > 0 {
+		lw.j.appendLine(lw.stream, strings.TrimRight(lw.buf.String(), "\r"))
+		lw.buf.Reset()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobRegistryWait(t *testing.T) {
+	jr := &jobRegistry{running: map[string]*job{}}
+
+	j, jobCtx := jr.start(context.Background(), "init.sh", roleAdmin)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := jr.wait(ctx); err == nil {
+		t.Fatal("expected wait to time out while a job is running")
+	}
+
+	jr.finish(j, errors.New("exit status 1"))
+	if state := j.info().State; state != jobFailed {
+		t.Errorf("expected job to be failed, got %s", state)
+	}
+	if err := jr.wait(context.Background()); err != nil {
+		t.Fatalf("expected wait to return once jobs finished, got %v", err)
+	}
+	if jobCtx.Err() == nil {
+		t.Error("expected the job context to be released once finished")
+	}
+}
+
+func TestJobOutputLines(t *testing.T) {
+	jr := &jobRegistry{running: map[string]*job{}}
+	j, _ := jr.start(context.Background(), "init.sh", roleAdmin)
+
+	out := j.output("stdout")
+	out.Write([]byte("creating chan"))
+	out.Write([]byte("nel\r\npeer joined\npartial"))
+
+	lines, next, over, _ := j.follow(0)
+	if len(lines) != 2 || lines[0].Text != "creating channel" || lines[1].Text != "peer joined" {
+		t.Fatalf("unexpected lines %+v", lines)
+	}
+	if over {
+		t.Fatal("expected job to still be running")
+	}
+
+	out.flush()
+	jr.finish(j, nil)
+
+	lines, _, over, _ = j.follow(next)
+	if len(lines) != 1 || lines[0].Text != "partial" {
+		t.Fatalf("expected only the flushed line after offset, got %+v", lines)
+	}
+	if !over {
+		t.Fatal("expected job to be over")
+	}
+	if jr.get(j.ID) != j {
+		t.Fatal("expected finished job to still be available")
+	}
+}
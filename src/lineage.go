@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// lineage policies selectable in the config
+const (
+	// lineageOff keeps no commit graph
+	lineageOff = "off"
+	// lineageFlag records every push, flagging the ones that break the
+	// lineage of their group
+	lineageFlag = "flag"
+	// lineageEnforce refuses the pushes that break the lineage
+	lineageEnforce = "enforce"
+)
+
+// flags of a push that breaks the lineage of its group
+const (
+	// flagDuplicate: the commit was already pushed to the group
+	flagDuplicate = "duplicate"
+	// flagMissingParent: no parent given although the group has commits
+	flagMissingParent = "missing-parent"
+	// flagUnknownParent: a parent was never pushed to the group
+	flagUnknownParent = "unknown-parent"
+	// flagStaleParent: the parent already has a child, the push forks
+	// from an old head without being a merge
+	flagStaleParent = "stale-parent"
+)
+
+// maxMergeParents bounds the parents of a merge besides the first one
+const maxMergeParents = 8
+
+// commitNode is a commit in the graph of its group
+type commitNode struct {
+	Commit string
+	// Parents are the first parent then the merged ones, none for the
+	// first commit of the group
+	Parents []string `json:",omitempty"`
+	Author  string
+	Pushed  time.Time
+	// Flags tell how the push broke the lineage, see lineageFlags
+	Flags []string `json:",omitempty"`
+}
+
+// lineageGraph is the json view of the graph of a group
+type lineageGraph struct {
+	Group string
+	// Heads are the commits nothing was pushed on yet, more than one
+	// when the group forked
+	Heads   []string
+	Commits []commitNode
+}
+
+// checkPush reads the lineage, metadata and signature fields of a push body
+// into cp
+func checkPush(body []byte, cp *ContentPost) error {
+	// they end up in the receipt
+	if err := checkPrintable(map[string]string{"Group": cp.Group, "Commit": cp.Commit, "Author": cp.Author}); err != nil {
+		return err
+	}
+	var lineage struct {
+		Parent string
+		Merge  []string
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &lineage); err != nil {
+			return err
+		}
+	}
+	if lineage.Parent == "" && len(lineage.Merge) > 0 {
+		return fmt.Errorf("a merge needs a Parent")
+	}
+	if len(lineage.Merge) > maxMergeParents {
+		return fmt.Errorf("more than %d Merge parents", maxMergeParents)
+	}
+	for _, h := range append([]string{lineage.Parent}, lineage.Merge...) {
+		if h != "" && !argTypes["hash"].MatchString(h) {
+			return fmt.Errorf("parent %q must be a hash", h)
+		}
+	}
+	// an enforced lineage only takes commits the next push can name as
+	// its parent
+	if cfg.Lineage == lineageEnforce && cp.Commit != "" && !argTypes["hash"].MatchString(cp.Commit) {
+		return fmt.Errorf("commit %q must be a hash", cp.Commit)
+	}
+	cp.Parent, cp.Merge = lineage.Parent, lineage.Merge
+	if err := checkCommitMetadata(body, cp); err != nil {
+		return err
+	}
+	return checkSignature(body, cp)
+}
+
+// pushNode returns the node a push adds to the graph of its group
+func pushNode(cp ContentPost) commitNode {
+	node := commitNode{Commit: cp.Commit, Author: cp.Author, Pushed: time.Now().UTC()}
+	if cp.Parent != "" {
+		node.Parents = append([]string{cp.Parent}, cp.Merge...)
+	}
+	return node
+}
+
+// heads returns the commits of nodes without children, sorted
+func heads(nodes map[string]commitNode) []string {
+	parents := map[string]bool{}
+	for _, n := range nodes {
+		for _, p := range n.Parents {
+			parents[p] = true
+		}
+	}
+	heads := []string{}
+	for c := range nodes {
+		if !parents[c] {
+			heads = append(heads, c)
+		}
+	}
+	sort.Strings(heads)
+	return heads
+}
+
+// lineageFlags tells how adding node to the graph nodes breaks its
+// lineage, nil if it does not
+func lineageFlags(nodes map[string]commitNode, node commitNode) []string {
+	if _, ok := nodes[node.Commit]; ok {
+		return []string{flagDuplicate}
+	}
+	if len(node.Parents) == 0 {
+		if len(nodes) > 0 {
+			return []string{flagMissingParent}
+		}
+		return nil
+	}
+
+	var flags []string
+	for _, p := range node.Parents {
+		if _, ok := nodes[p]; !ok {
+			flags = append(flags, flagUnknownParent)
+			break
+		}
+	}
+	// a merge may join any commits, a plain push must build on a head
+	if len(node.Parents) == 1 && flags == nil {
+		isHead := false
+		for _, h := range heads(nodes) {
+			isHead = isHead || h == node.Parents[0]
+		}
+		if !isHead {
+			flags = append(flags, flagStaleParent)
+		}
+	}
+	return flags
+}
+
+// lineageProblem describes flags to the client, with the heads to pull
+// from
+func lineageProblem(group string, flags []string, nodes map[string]commitNode) string {
+	return fmt.Sprintf("lineage of %s broken (%s), its heads are [%s]",
+		group, strings.Join(flags, ", "), strings.Join(heads(nodes), ", "))
+}
+
+// reserveLineage adds, when the lineage is enforced, a push to the graph of
+// its group before its script runs, and refuses it if it breaks the
+// lineage. The check and the add are one, so of two pushes on the same head
+// the second one sees the first, even on another replica. releaseLineage
+// takes the push back if it fails.
+func (uh userHandler) reserveLineage(ctx context.Context, cp ContentPost) error {
+	if cfg.Lineage != lineageEnforce {
+		return nil
+	}
+	flags, err := uh.store.addCommitNode(ctx, cp.Group, pushNode(cp), true)
+	if err != nil {
+		return err
+	}
+	if flags != nil {
+		nodes, err := uh.store.lineage(ctx, cp.Group)
+		if err != nil {
+			return err
+		}
+		return &scriptError{status: http.StatusConflict, msg: lineageProblem(cp.Group, flags, nodes)}
+	}
+	return nil
+}
+
+// releaseLineage takes a push reserved by reserveLineage out of the graph,
+// its script did not get it on chain
+func (uh userHandler) releaseLineage(ctx context.Context, cp ContentPost) {
+	if cfg.Lineage != lineageEnforce {
+		return
+	}
+	if err := uh.store.removeCommitNode(ctx, cp.Group, cp.Commit); err != nil {
+		loggerFrom(ctx).Warn("failed to release commit lineage", "group", cp.Group, "commit", cp.Commit, "error", err)
+	}
+}
+
+// recordLineage adds a successful push to the graph of its group. The push
+// is on chain by now, what breaks the lineage is only flagged and reported
+// as a warning. Enforced pushes were recorded by reserveLineage.
+func (uh userHandler) recordLineage(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	if cfg.Lineage != lineageFlag {
+		return
+	}
+	flags, err := uh.store.addCommitNode(ctx, cp.Group, pushNode(cp), false)
+	if err != nil {
+		loggerFrom(ctx).Warn("failed to record commit lineage", "group", cp.Group, "commit", cp.Commit, "error", err)
+		return
+	}
+	if flags != nil {
+		loggerFrom(ctx).Warn("push breaks the lineage", "group", cp.Group, "commit", cp.Commit, "flags", flags)
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("lineage of %s broken: %s", cp.Group, strings.Join(flags, ", ")))
+	}
+}
+
+// getLineage returns the commit graph of a group, oldest push first
+func (uh userHandler) getLineage(w http.ResponseWriter, r *http.Request) {
+	group := mux.Vars(r)["Group"]
+	nodes, err := uh.store.lineage(r.Context(), group)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	graph := lineageGraph{Group: group, Heads: heads(nodes), Commits: make([]commitNode, 0, len(nodes))}
+	for _, n := range nodes {
+		graph.Commits = append(graph.Commits, n)
+	}
+	sort.Slice(graph.Commits, func(i, j int) bool {
+		a, b := graph.Commits[i], graph.Commits[j]
+		return a.Pushed.Before(b.Pushed) || a.Pushed.Equal(b.Pushed) && a.Commit < b.Commit
+	})
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(graph)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineageFlags(t *testing.T) {
+	// aa01 <- bb01 <- cc01
+	//      <- bb02
+	nodes := map[string]commitNode{
+		"aa01": {Commit: "aa01"},
+		"bb01": {Commit: "bb01", Parents: []string{"aa01"}},
+		"bb02": {Commit: "bb02", Parents: []string{"aa01"}},
+		"cc01": {Commit: "cc01", Parents: []string{"bb01"}},
+	}
+	if got := heads(nodes); !reflect.DeepEqual(got, []string{"bb02", "cc01"}) {
+		t.Errorf("expected heads bb02 and cc01, got %q", got)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		commit  string
+		parents []string
+		want    []string
+	}{
+		{"on a head", "dd01", []string{"cc01"}, nil},
+		{"on the other head", "dd01", []string{"bb02"}, nil},
+		{"stale", "dd01", []string{"bb01"}, []string{flagStaleParent}},
+		{"unknown", "dd01", []string{"ff01"}, []string{flagUnknownParent}},
+		{"no parent", "dd01", nil, []string{flagMissingParent}},
+		{"duplicate", "bb01", []string{"aa01"}, []string{flagDuplicate}},
+		{"merge", "dd01", []string{"cc01", "bb02"}, nil},
+		{"merge of old commits", "dd01", []string{"bb01", "aa01"}, nil},
+		{"merge of an unknown commit", "dd01", []string{"cc01", "ff01"}, []string{flagUnknownParent}},
+	} {
+		if got := lineageFlags(nodes, commitNode{Commit: tc.commit, Parents: tc.parents}); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+
+	if got := lineageFlags(map[string]commitNode{}, commitNode{Commit: "aa01"}); got != nil {
+		t.Errorf("expected the first commit to need no parent, got %q", got)
+	}
+}
+
+func TestCheckPush(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"Parent": "aa01", "Merge": ["bb02"]}`: "",
+		`{"Merge": ["bb02"]}`:                   "a merge needs a Parent",
+		`{"Parent": "main"}`:                    "must be a hash",
+		`{"Parent": "aa01", "Merge": "bb02"}`:   "cannot unmarshal",
+	} {
+		cp := ContentPost{Commit: "dd01"}
+		err := checkPush([]byte(body), &cp)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: expected error %q, got %v", body, want, err)
+		}
+	}
+
+	// the commit is a parent of the next push
+	oldCfg := cfg
+	defer func() { cfg = oldCfg }()
+	for lineage, refused := range map[string]bool{lineageOff: false, lineageFlag: false, lineageEnforce: true} {
+		cfg.Lineage = lineage
+		err := checkPush([]byte(`{"Parent": "aa01"}`), &ContentPost{Commit: "v1.0"})
+		if refused && (err == nil || !strings.Contains(err.Error(), "must be a hash")) || !refused && err != nil {
+			t.Errorf("%s: expected a commit that is no hash to be refused %v, got %v", lineage, refused, err)
+		}
+	}
+}
+
+// pushLineage pushes commit on parents and returns the status and answer
+func (env *testEnv) pushLineage(t *testing.T, author, commit string, parents ...string) (int, scriptResponse) {
+	t.Helper()
+	body := map[string]interface{}{"Author": author, "Group": "g1", "Commit": commit}
+	if len(parents) > 0 {
+		body["Parent"] = parents[0]
+	}
+	if len(parents) > 1 {
+		body["Merge"] = parents[1:]
+	}
+	resp := env.post(t, "/push", "", body)
+	defer resp.Body.Close()
+	var answer scriptResponse
+	json.NewDecoder(resp.Body).Decode(&answer)
+	return resp.StatusCode, answer
+}
+
+func TestLineageFlagged(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+
+	for _, p := range []struct {
+		author, commit string
+		parents        []string
+		warned         bool
+	}{
+		{"alice", "aa01", nil, false},
+		{"alice", "bb01", []string{"aa01"}, false},
+		// bob had not pulled bb01
+		{"bob", "bb02", []string{"aa01"}, true},
+		{"bob", "cc01", []string{"bb02", "bb01"}, false},
+	} {
+		status, answer := env.pushLineage(t, p.author, p.commit, p.parents...)
+		if status != http.StatusOK || (len(answer.Warnings) > 0) != p.warned {
+			t.Errorf("%s: expected 200 warned %v, got %d %q", p.commit, p.warned, status, answer.Warnings)
+		}
+	}
+
+	var graph lineageGraph
+	json.NewDecoder(env.get(t, "/groups/g1/lineage").Body).Decode(&graph)
+	if !reflect.DeepEqual(graph.Heads, []string{"cc01"}) || len(graph.Commits) != 4 {
+		t.Fatalf("expected 4 commits merged into cc01, got %+v", graph)
+	}
+	for _, c := range graph.Commits {
+		if c.Commit == "bb02" && !reflect.DeepEqual(c.Flags, []string{flagStaleParent}) {
+			t.Errorf("expected bb02 to be flagged stale, got %+v", c)
+		}
+		if c.Commit == "cc01" && !reflect.DeepEqual(c.Parents, []string{"bb02", "bb01"}) {
+			t.Errorf("expected cc01 to merge bb02 and bb01, got %+v", c)
+		}
+	}
+}
+
+func TestLineageEnforced(t *testing.T) {
+	env := newTestEnv(t)
+	cfg.Lineage = lineageEnforce
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+
+	env.pushLineage(t, "alice", "aa01")
+	env.pushLineage(t, "alice", "bb01", "aa01")
+	pushes := len(env.vm.Commands())
+
+	for _, parents := range [][]string{{"aa01"}, {"ff01"}, nil} {
+		if status, _ := env.pushLineage(t, "bob", "bb02", parents...); status != http.StatusConflict {
+			t.Errorf("parents %q: expected 409, got %d", parents, status)
+		}
+	}
+	if len(env.vm.Commands()) != pushes {
+		t.Error("expected the refused pushes not to reach the VM")
+	}
+	if status, _ := env.pushLineage(t, "bob", "bb02", "bb01"); status != http.StatusOK {
+		t.Errorf("expected a push on the head to succeed, got %d", status)
+	}
+}
+
+func TestLineageEnforcedConcurrentPushes(t *testing.T) {
+	env := newTestEnv(t)
+	cfg.Lineage = lineageEnforce
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+	env.pushLineage(t, "alice", "aa01")
+
+	// alice's push is on its way to the chain when bob pushes on the
+	// same parent
+	release := make(chan struct{})
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n", Wait: release})
+	done := make(chan int, 1)
+	go func() {
+		status, _ := env.pushLineage(t, "alice", "bb01", "aa01")
+		done <- status
+	}()
+	waitFor(t, "alice's push to start", func() bool { return len(env.vm.Commands()) == 2 })
+	if status, _ := env.pushLineage(t, "bob", "bb02", "aa01"); status != http.StatusConflict {
+		t.Errorf("expected bob to be told to pull first, got %d", status)
+	}
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("expected alice's push to succeed, got %d", status)
+	}
+	if status, _ := env.pushLineage(t, "bob", "bb02", "aa01"); status != http.StatusConflict {
+		t.Errorf("expected bob to be refused once alice's push is in, got %d", status)
+	}
+
+	// a push that fails on chain gives its place back
+	env.vm.script("push.sh", scriptResult{Stderr: "endorsement failure\n", Status: 1})
+	if status, _ := env.pushLineage(t, "bob", "cc01", "bb01"); status == http.StatusOK {
+		t.Fatal("expected the push to fail")
+	}
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+	if status, answer := env.pushLineage(t, "bob", "cc01", "bb01"); status != http.StatusOK || len(answer.Warnings) != 0 {
+		t.Errorf("expected the push to go through again, got %d %q", status, answer.Warnings)
+	}
+	var graph lineageGraph
+	json.NewDecoder(env.get(t, "/groups/g1/lineage").Body).Decode(&graph)
+	if !reflect.DeepEqual(graph.Heads, []string{"cc01"}) || len(graph.Commits) != 3 {
+		t.Errorf("expected aa01, bb01 then cc01, got %+v", graph)
+	}
+}
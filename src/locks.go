@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// lock scopes of an operation
+const (
+	// lockGlobal operations run alone on the VM
+	lockGlobal = "global"
+	// lockGroup operations only exclude other operations on the same group
+	// and global ones
+	lockGroup = "group"
+	// lockNone operations never wait for anything
+	lockNone = "none"
+)
+
+// lockManager hands out the global and per group locks on the blockchain
+// network. Locks are never waited for, a busy network is reported to the
+// client who tries again.
+type lockManager struct {
+	mu     sync.Mutex
+	global bool
+	groups map[string]bool
+}
+
+var locks = &lockManager{groups: map[string]bool{}}
+
+// tryLock takes the lock of scope, for group when scope is lockGroup. It
+// returns false if the lock is held, otherwise a function releasing it.
+func (lm *lockManager) tryLock(scope, group string) (func(), bool) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	switch scope {
+	case lockNone:
+		return func() {}, true
+	case lockGroup:
+		if lm.global || lm.groups[group] {
+			return nil, false
+		}
+		lm.groups[group] = true
+		return func() {
+			lm.mu.Lock()
+			delete(lm.groups, group)
+			lm.mu.Unlock()
+		}, true
+	default:
+		if lm.global || len(lm.groups) > 0 {
+			return nil, false
+		}
+		lm.global = true
+		return func() {
+			lm.mu.Lock()
+			lm.global = false
+			lm.mu.Unlock()
+		}, true
+	}
+}
+
+// lockState is the json view of the held locks
+type lockState struct {
+	Global bool
+	Groups []string
+}
+
+// state returns the locks currently held
+func (lm *lockManager) state() lockState {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	st := lockState{Global: lm.global, Groups: []string{}}
+	for g := range lm.groups {
+		st.Groups = append(st.Groups, g)
+	}
+	sort.Strings(st.Groups)
+	return st
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestLockScopes(t *testing.T) {
+	lm := &lockManager{groups: map[string]bool{}}
+
+	releaseG1, ok := lm.tryLock(lockGroup, "g1")
+	if !ok {
+		t.Fatal("expected group lock")
+	}
+	if _, ok := lm.tryLock(lockGroup, "g1"); ok {
+		t.Error("expected the same group to be locked out")
+	}
+	releaseG2, ok := lm.tryLock(lockGroup, "g2")
+	if !ok {
+		t.Error("expected another group to run alongside")
+	}
+	if _, ok := lm.tryLock(lockGlobal, ""); ok {
+		t.Error("expected global lock to wait for the groups")
+	}
+	if _, ok := lm.tryLock(lockNone, ""); !ok {
+		t.Error("expected lock free operations to always run")
+	}
+
+	releaseG1()
+	releaseG2()
+	releaseGlobal, ok := lm.tryLock(lockGlobal, "")
+	if !ok {
+		t.Fatal("expected global lock once groups are released")
+	}
+	if _, ok := lm.tryLock(lockGroup, "g1"); ok {
+		t.Error("expected groups to wait for the global lock")
+	}
+	if st := lm.state(); !st.Global || len(st.Groups) != 0 {
+		t.Errorf("unexpected state %+v", st)
+	}
+	releaseGlobal()
+}
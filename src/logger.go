@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel orders log lines by importance
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// parseLevel reads a level name as used in the config
+func parseLevel(s string) (logLevel, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// jsonLogger writes one json object per line with a level, a message and
+// key/value fields. Loggers derived with With share the output.
+type jsonLogger struct {
+	out    *syncWriter
+	level  *logLevel
+	fields []interface{}
+}
+
+// syncWriter serializes the writes of every logger sharing it
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// logger is the root logger, everything goes through the redacting writer
+var logger = newLogger(redactingWriter{os.Stderr}, levelInfo)
+
+func newLogger(w io.Writer, level logLevel) *jsonLogger {
+	return &jsonLogger{out: &syncWriter{w: w}, level: &level}
+}
+
+// With returns a logger adding the key/value pairs kv to every line
+func (l *jsonLogger) With(kv ...interface{}) *jsonLogger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &jsonLogger{out: l.out, level: l.level, fields: fields}
+}
+
+// setLevel changes the minimum level of l and every logger derived from it
+func (l *jsonLogger) setLevel(level logLevel) {
+	l.out.mu.Lock()
+	*l.level = level
+	l.out.mu.Unlock()
+}
+
+func (l *jsonLogger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *jsonLogger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *jsonLogger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *jsonLogger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *jsonLogger) log(level logLevel, msg string, kv []interface{}) {
+	l.out.mu.Lock()
+	enabled := level >= *l.level
+	l.out.mu.Unlock()
+	if !enabled {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, levelNames[level])
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+
+	fields := append(append([]interface{}(nil), l.fields...), kv...)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		buf.WriteByte(',')
+		writeJSON(&buf, key)
+		buf.WriteByte(':')
+		writeJSON(&buf, value)
+	}
+	buf.WriteString("}\n")
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+// writeJSON encodes v, falling back to its string form
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// stdLogWriter turns lines written through the standard log package, like
+// the errors of net/http, into log lines of level
+type stdLogWriter struct {
+	l     *jsonLogger
+	level logLevel
+}
+
+func (sw stdLogWriter) Write(p []byte) (int, error) {
+	sw.l.log(sw.level, strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	loggerKey
+	identityKey
+)
+
+// maxRequestIDLen bounds the ids accepted from clients
+const maxRequestIDLen = 64
+
+// requestID returns the id of the request ctx belongs to, if any
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// identity returns who the client certificate of the request ctx belongs
+// to, if any
+func identity(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey).(string)
+	return id
+}
+
+// loggerFrom returns the request logger stored in ctx, or the root logger
+func loggerFrom(ctx context.Context) *jsonLogger {
+	if l, ok := ctx.Value(loggerKey).(*jsonLogger); ok {
+		return l
+	}
+	return logger
+}
+
+// validRequestID only accepts ids that are safe to pass on a command line
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestLogging gives every request an id, taken from X-Request-ID when the
+// client sent a valid one, returns it in the response, attaches a logger
+// carrying it, and the identity of the client certificate, to the context
+// and writes an access log line once done
+func requestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		l := logger.With("request_id", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		if client, ok := clientIdentity(r); ok {
+			l = l.With("client", client)
+			ctx = context.WithValue(ctx, identityKey, client)
+		}
+		ctx = context.WithValue(ctx, loggerKey, l)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		l.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// statusRecorder remembers the status and size of a response. It keeps
+// flushing (job streams) and hijacking (websockets) working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer can't be hijacked")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
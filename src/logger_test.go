@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, levelInfo)
+
+	l.Debug("hidden")
+	l.With("request_id", "abc").Warn("locked out", "group", "g1", "error", errors.New("busy"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected the debug line to be filtered, got %q", out.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"level": "warn", "msg": "locked out", "request_id": "abc", "group": "g1", "error": "busy"}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("expected %s=%q, got %v", k, v, entry[k])
+		}
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	var out bytes.Buffer
+	oldLogger := logger
+	logger = newLogger(&out, levelInfo)
+	defer func() { logger = oldLogger }()
+
+	var seen string
+	h := requestLogging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest("GET", "/history", nil)
+	req.Header.Set("X-Request-ID", "client-id-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if seen != "client-id-1" || rec.Header().Get("X-Request-ID") != "client-id-1" {
+		t.Errorf("expected the client id to be kept, got %q / %q", seen, rec.Header().Get("X-Request-ID"))
+	}
+	if !strings.Contains(out.String(), `"status":418`) || !strings.Contains(out.String(), `"request_id":"client-id-1"`) {
+		t.Errorf("unexpected access log %q", out.String())
+	}
+
+	req = httptest.NewRequest("GET", "/history", nil)
+	req.Header.Set("X-Request-ID", "bad id; rm -rf /")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if seen == "bad id; rm -rf /" || !validRequestID(seen) {
+		t.Errorf("expected an unsafe id to be replaced, got %q", seen)
+	}
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"sync/atomic"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/ssh"
 )
@@ -22,201 +19,137 @@ type ContentPost struct {
 	Group  string
 	Commit string
 	IP     string
+	// Parent is the commit this one builds on, Merge the other parents
+	// when it is a merge
+	Parent string
+	Merge  []string
+	// Metadata describes the pushed commit, when the client sent any
+	Metadata *commitMetadata `json:"-"`
+	// Signature is the proof the Author authorized the push, if signed
+	Signature *pushSignature `json:"-"`
 }
 
 // create a data structure that can hold the response from the script
 type scriptResponse struct {
 	Response string
+	// Result is the output as read by the parser of the operation
+	Result interface{} `json:",omitempty"`
+	// Warnings are the problems that did not stop the operation
+	Warnings []string `json:",omitempty"`
+	// Receipt is the signed proof a push was accepted
+	Receipt *receipt `json:",omitempty"`
 }
 
 type userHandler struct {
-	client *redis.Client
+	store store
 }
 
-var (
-    locker    uint32
-)
-
 const keyPrefix = "user:"
 
-var appIP string = os.Getenv("VM_PUBLIC_IP") + ":22"
-var vmUsername string = os.Getenv("VM_USERNAME")
-var vmPassword string = os.Getenv("VM_PASSWORD")
-var redisHost string = os.Getenv("REDIS_HOST")
-var redisPassword string = os.Getenv("REDIS_PASSWORD")
-
 // Existing code from above
-func handleRequests() {
-
-	op := &redis.Options{Addr: redisHost, Password: redisPassword, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}, WriteTimeout: 5 * time.Second, MaxRetries: 3}
-	client := redis.NewClient(op)
-
-	ctx := context.Background()
-	err := client.Ping(ctx).Err()
+func handleRequests(reg *registry) {
+	st, err := newStore()
 	if err != nil {
-		log.Fatalf("failed to connect with redis instance at %s - %v", redisHost, err)
+		logger.Error("can't set up the store", "error", err)
+		os.Exit(1)
 	}
 
-	log.Println("Reached server")
-
-	uh := userHandler{client: client}
-
-	myRouter := mux.NewRouter().StrictSlash(true)
-	// creates a new instance of a mux router
-	myRouter.HandleFunc("/test", testFunc).Methods("POST")
-
-	// admin commands
-	myRouter.HandleFunc("/init", initNet).Methods("POST")
-	myRouter.HandleFunc("/clear", uh.clearNet).Methods("POST")
-	myRouter.HandleFunc("/history", historyNet).Methods("POST")
-
-	// student commands
-	myRouter.HandleFunc("/creategroup", createGrp).Methods("POST")
-	myRouter.HandleFunc("/registernumber", uh.registerNr).Methods("POST")
-	myRouter.HandleFunc("/users/{Author}", uh.getUser).Methods("GET")
-	myRouter.HandleFunc("/push", pushHash).Methods("POST")
-
 	// finally, instead of passing in nil, we want
-	// to pass in our newly created router as the second
-	// argument
-	log.Fatal(http.ListenAndServe(":8010", myRouter))
-}
-
-func initNet(w http.ResponseWriter, r *http.Request) {
-	// get the body of our POST request
-	// unmarshal this into a new Article struct
-	// append this to our Articles array.
-	reqBody, err := ioutil.ReadAll(r.Body)
-
-	log.Println("Reached function")
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	var cp ContentPost
-	json.Unmarshal(reqBody, &cp)
-
-	password := cp.Author
-	if password != vmPassword {
-		log.Println("Password given: "+password)
-		log.Println("Correct password: "+password)
-		http.Error(w, "Wrong Password", http.StatusForbidden)
-		return
-	}
-
-	config := &ssh.ClientConfig{
-		User: vmUsername,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(vmPassword)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	conn, err := ssh.Dial("tcp", appIP, config)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-
-	// TODO: check if user is admin
-	runCommand("sudo /var/lib/waagent/custom-script/download/0/project/bloc-server/commands/init.sh "+cp.Author+" "+cp.Group+" "+cp.Commit, conn, w)
-}
-
-func (uh userHandler) clearNet(w http.ResponseWriter, r *http.Request) {
-	// get the body of our POST request
-	// unmarshal this into a new Article struct
-	// append this to our Articles array.
-	reqBody, err := ioutil.ReadAll(r.Body)
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	// to pass in our newly created router as the handler
+	// of the server
+	srv := &http.Server{
+		Addr:     cfg.httpAddr(),
+		Handler:  newRouter(st, reg),
+		ErrorLog: log.New(stdLogWriter{logger, levelWarn}, "", 0),
 	}
-
-	var cp ContentPost
-	json.Unmarshal(reqBody, &cp)
-
-	password := cp.Author
-	if password != vmPassword {
-		log.Println("Password given: "+password)
-		log.Println("Correct password: "+password)
-		http.Error(w, "Wrong Password", http.StatusForbidden)
-		return
+	if err := serverTLS.load(cfg); err != nil {
+		logger.Error("can't load the TLS certificate", "error", err)
+		os.Exit(1)
 	}
-
-	_, err = uh.client.FlushAll(r.Context()).Result()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if srv.TLSConfig, err = serverTLS.tlsConfig(cfg); err != nil {
+		logger.Error("can't set up TLS", "error", err)
+		os.Exit(1)
 	}
-
-	config := &ssh.ClientConfig{
-		User: vmUsername,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(vmPassword)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	if err := receipts.load(cfg); err != nil {
+		logger.Error("can't load the receipt key", "error", err)
+		os.Exit(1)
 	}
-
-	conn, err := ssh.Dial("tcp", appIP, config)
-	if err != nil {
-		panic(err)
+	if err := serve(srv, st); err != nil && err != http.ErrServerClosed {
+		logger.Error("server failed", "error", err)
+		os.Exit(1)
 	}
-	defer conn.Close()
-
-	// TODO: check if user is admin
-	runCommand("sudo /var/lib/waagent/custom-script/download/0/project/bloc-server/commands/clear.sh", conn, w)
+	logger.Info("server stopped")
 }
 
+// newRouter maps the routes of the API to their handlers
+func newRouter(st store, reg *registry) *mux.Router {
+	uh := userHandler{store: st}
+	hh := healthHandler{store: st}
+	oh := newOpHandler(st)
 
-func historyNet(w http.ResponseWriter, r *http.Request) {
-	// get the body of our POST request
-	// unmarshal this into a new Article struct
-	// append this to our Articles array.
-	reqBody, _ := ioutil.ReadAll(r.Body)
+	myRouter := mux.NewRouter().StrictSlash(true)
+	myRouter.Use(requestLogging, requireKnownClient, cors)
 
-	var cp ContentPost
-	json.Unmarshal(reqBody, &cp)
+	// probes
+	myRouter.HandleFunc("/healthz", hh.liveness).Methods("GET")
+	myRouter.HandleFunc("/readyz", hh.readiness).Methods("GET")
 
-	config := &ssh.ClientConfig{
-		User: vmUsername,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(vmPassword)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	// bloc-server commands (init, clear, history, creategroup, push, test
+	// and whatever else the operations file defines)
+	for _, op := range reg.ops {
+		myRouter.HandleFunc("/"+op.Name, oh.serve(op)).Methods("POST")
 	}
+	// operations defined by the admins, reloaded without restarting
+	myRouter.HandleFunc("/ops", oh.listCustom).Methods("GET")
+	myRouter.HandleFunc("/ops/{Name}", oh.serveCustom).Methods("POST")
+	myRouter.HandleFunc("/jobs", listJobs).Methods("GET")
+	myRouter.HandleFunc("/jobs/{ID}", uh.getJob).Methods("GET")
+	myRouter.HandleFunc("/jobs/{ID}/stream", streamJob).Methods("GET")
 
-	conn, err := ssh.Dial("tcp", appIP, config)
-	if err != nil {
-		panic(err)
+	// student commands
+	myRouter.HandleFunc("/registernumber", uh.registerNr).Methods("POST")
+	myRouter.HandleFunc("/users/{Author}", uh.getUser).Methods("GET")
+	myRouter.HandleFunc("/users/{Author}/key", uh.putKey).Methods("PUT")
+	myRouter.HandleFunc("/users/{Author}/key", uh.getKey).Methods("GET")
+	myRouter.HandleFunc("/users/{Author}/enrolment", uh.issueEnrolment).Methods("POST")
+	myRouter.HandleFunc("/receipts/key", getReceiptKey).Methods("GET")
+	myRouter.HandleFunc("/receipts/verify", verifyReceipt).Methods("POST")
+	myRouter.HandleFunc("/groups", uh.listGroups).Methods("GET")
+	myRouter.HandleFunc("/groups/{Group}/members", uh.getMembers).Methods("GET")
+	myRouter.HandleFunc("/groups/{Group}/lineage", uh.getLineage).Methods("GET")
+	myRouter.HandleFunc("/groups/{Group}/commits/{Hash}", oh.getCommit(reg.byName["history"])).Methods("GET")
+	myRouter.HandleFunc("/v1/groups/{Group}/commits/{Hash}", oh.getCommit(reg.byName["history"])).Methods("GET")
+	myRouter.HandleFunc("/groups/{Group}/stats", oh.getStats(reg.byName["history"])).Methods("GET")
+	myRouter.HandleFunc("/groups/{Group}/export", oh.exportHistory(reg.byName["history"])).Methods("GET")
+	myRouter.HandleFunc("/export", oh.exportHistory(reg.byName["history"])).Methods("GET")
+	myRouter.HandleFunc("/events/{Group}", uh.groupEvents).Methods("GET")
+
+	// teacher dashboard
+	myRouter.HandleFunc("/audit", uh.getAudit).Methods("GET")
+	myRouter.HandleFunc("/search", uh.searchHashes).Methods("GET")
+	myRouter.HandleFunc("/duplicates", uh.getDuplicates).Methods("GET")
+	if cfg.Dashboard {
+		myRouter.PathPrefix("/dashboard").Handler(dashboardHandler()).Methods("GET")
 	}
-	defer conn.Close()
 
-	runCommand("sudo /var/lib/waagent/custom-script/download/0/project/bloc-server/commands/gethistory.sh "+cp.Group, conn, w)
-}
-
-func createGrp(w http.ResponseWriter, r *http.Request) {
-	// get the body of our POST request
-	// unmarshal this into a new Article struct
-	// append this to our Articles array.
-	reqBody, _ := ioutil.ReadAll(r.Body)
+	// browser preflights, on any route. Not a Methods matcher, which would
+	// turn the 404 of unknown paths into 405.
+	myRouter.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+		return r.Method == http.MethodOptions
+	}).HandlerFunc(preflight)
 
-	var cp ContentPost
-	json.Unmarshal(reqBody, &cp)
+	return myRouter
+}
 
-	config := &ssh.ClientConfig{
-		User: vmUsername,
+// sshClientConfig returns the credentials used to log into the VM
+func sshClientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User: cfg.VMUsername,
 		Auth: []ssh.AuthMethod{
-			ssh.Password(vmPassword)},
+			ssh.Password(cfg.VMPassword.Get())},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
 	}
-
-	conn, err := ssh.Dial("tcp", appIP, config)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-
-	runCommand("sudo /var/lib/waagent/custom-script/download/0/project/bloc-server/commands/createchannel.sh "+cp.Author+" "+cp.Group+" "+cp.Commit, conn, w)
 }
 
 func (uh userHandler) registerNr(w http.ResponseWriter, r *http.Request) {
@@ -238,7 +171,7 @@ func (uh userHandler) registerNr(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userid := u["Author"].(string)
-	_, err = uh.client.HSet(r.Context(), keyPrefix+userid, u).Result()
+	err = uh.store.saveUser(r.Context(), userid, u)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -249,7 +182,7 @@ func (uh userHandler) registerNr(w http.ResponseWriter, r *http.Request) {
 
 func (uh userHandler) getUser(w http.ResponseWriter, r *http.Request) {
 	userid := mux.Vars(r)["Author"]
-	info, err := uh.client.HGetAll(r.Context(), keyPrefix+userid).Result()
+	info, err := uh.store.user(r.Context(), userid)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -269,99 +202,90 @@ func (uh userHandler) getUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func pushHash(w http.ResponseWriter, r *http.Request) {
-	// get the body of our POST request
-	// unmarshal this into a new Article struct
-	// append this to our Articles array.
-	reqBody, _ := ioutil.ReadAll(r.Body)
-
-	var cp ContentPost
-	json.Unmarshal(reqBody, &cp)
-
-	config := &ssh.ClientConfig{
-		User: vmUsername,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(vmPassword)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	conn, err := ssh.Dial("tcp", appIP, config)
+// getMembers returns the students who joined a group
+func (uh userHandler) getMembers(w http.ResponseWriter, r *http.Request) {
+	members, err := uh.store.members(r.Context(), mux.Vars(r)["Group"])
 	if err != nil {
-		panic(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	defer conn.Close()
 
-	runCommand("sudo /var/lib/waagent/custom-script/download/0/project/bloc-server/commands/push.sh "+cp.Author+" "+cp.Group+" "+cp.Commit, conn, w)
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
 }
 
-func testFunc(w http.ResponseWriter, r *http.Request) {
-	// get the body of our POST request
-	// unmarshal this into a new Article struct
-	// append this to our Articles array.
-	reqBody, _ := ioutil.ReadAll(r.Body)
-	log.Println(reqBody)
-
-	var cp ContentPost
-	json.Unmarshal(reqBody, &cp)
-
-	config := &ssh.ClientConfig{
-		User: vmUsername,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(vmPassword)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
+// groupInfo is the json view of a group and its members
+type groupInfo struct {
+	Name    string
+	Members []string
+}
 
-	conn, err := ssh.Dial("tcp", appIP, config)
+// listGroups returns every group with its members
+func (uh userHandler) listGroups(w http.ResponseWriter, r *http.Request) {
+	names, err := uh.store.groups(r.Context())
 	if err != nil {
-		panic(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	defer conn.Close()
 
-	log.Println(cp)
-	log.Println(cp.Author)
-	log.Println(cp.Group)
-	log.Println(cp.Commit)
+	groups := make([]groupInfo, 0, len(names))
+	for _, name := range names {
+		members, err := uh.store.members(r.Context(), name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		groups = append(groups, groupInfo{Name: name, Members: members})
+	}
 
-	// Call Run method with command you want to run on remote server.
-	runCommand("sudo /var/lib/waagent/custom-script/download/0/project/bloc-server/commands/test.sh "+cp.Author+" "+cp.Group+" "+cp.Commit, conn, w)
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
 }
 
-func runCommand(cmd string, conn *ssh.Client, w http.ResponseWriter) {
-	if !atomic.CompareAndSwapUint32(&locker, 0, 1) {
-		log.Println("Locked out")
-		w.WriteHeader(500)
-		panic("Blockchain network being used, try again next time")
-    }                                          
-    defer atomic.StoreUint32(&locker, 0)  
-
-	sess, err := conn.NewSession()
-	if err != nil {
-		panic(err)
+func main() {
+	// "gatherchain-app config [flags]" prints the effective configuration
+	args := os.Args[1:]
+	printConfig := len(args) > 0 && args[0] == "config"
+	if printConfig {
+		args = args[1:]
 	}
-	defer sess.Close()     
 
-	results, err := sess.Output(cmd)
+	// whatever still uses the standard logger ends up in the json log
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{logger, levelInfo})
+
+	c, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		return
+	}
+	if printConfig && c != nil {
+		c.write(os.Stdout)
+	}
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(500)
-		panic("Can't run remote command: " + err.Error())
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	if printConfig {
+		return
 	}
+	cfg = c
+	level, _ := parseLevel(cfg.LogLevel)
+	logger.setLevel(level)
 
-	// convert results into string and populate an instance of
-	// the scriptResponse struct
-	response := scriptResponse{string(results)}
-	// encode response into JSON and deliver back to user
-	encoder := json.NewEncoder(w)
-	err = encoder.Encode(response)
+	reg, err := loadOperations(cfg.OperationsFile)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(500)
-		panic("Can't return remote command output: " + err.Error())
+		logger.Error("invalid operations", "error", err)
+		os.Exit(1)
+	}
+	if vm, err = newBackend(); err != nil {
+		logger.Error("can't start the backend", "error", err)
+		os.Exit(1)
+	}
+	if err := customOps.load(cfg.CustomOperationsFile); err != nil {
+		logger.Error("invalid custom operations", "error", err)
+		os.Exit(1)
 	}
-}
 
-func main() {
-	port := 8010
-	log.Printf("Starting webserver on port %d\n", port)
-	handleRequests()
+	logger.Info("starting webserver", "port", cfg.HTTPPort, "backend", cfg.Backend)
+	handleRequests(reg)
 }
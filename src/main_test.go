@@ -1,7 +1,583 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
 
-func Test(t *testing.T) {
-	// TODO
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// testEnv is the whole server running against a test ssh server for the VM
+// and an in memory redis
+type testEnv struct {
+	srv   *httptest.Server
+	vm    *testSSHServer
+	redis *miniredis.Miniredis
+	store store
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	oldCfg, oldVM := cfg, vm
+	t.Cleanup(func() { cfg, vm = oldCfg, oldVM })
+
+	// hijacked connections outlive the server, wait for their handlers
+	// before the config is put back
+	var handlers sync.WaitGroup
+	t.Cleanup(handlers.Wait)
+
+	env := &testEnv{vm: newTestSSHServer(t)}
+	var err error
+	if env.redis, err = miniredis.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(env.redis.Close)
+
+	host, port, _ := net.SplitHostPort(env.vm.Addr)
+	cfg = defaultConfig()
+	cfg.VMHost = host
+	cfg.VMPort, _ = strconv.Atoi(port)
+	cfg.VMUsername = env.vm.User
+	cfg.VMPassword.Set(env.vm.Password)
+	cfg.ScriptsDir = "/opt/bloc-server/commands"
+	vm = sshBackend{}
+
+	loadReceiptKey(t)
+
+	env.store = newRedisStore(redis.NewClient(&redis.Options{Addr: env.redis.Addr()}))
+	t.Cleanup(func() { env.store.Close() })
+	reg, err := loadOperations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter(env.store, reg)
+	env.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(env.srv.Close)
+	return env
+}
+
+// post sends body as json to path with reqID as the request id
+func (env *testEnv) post(t *testing.T, path, reqID string, body interface{}) *http.Response {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", env.srv.URL+path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if reqID != "" {
+		req.Header.Set("X-Request-ID", reqID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func (env *testEnv) get(t *testing.T, path string) *http.Response {
+	t.Helper()
+	resp, err := http.Get(env.srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// admin sends a GET with the admin password
+func (env *testEnv) admin(t *testing.T, path string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("GET", env.srv.URL+path, nil)
+	req.Header.Set(adminPasswordHeader, env.vm.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// waitFor polls cond until it holds or a second went by
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	env := newTestEnv(t)
+
+	if resp := env.get(t, "/healthz"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected /healthz to answer 200, got %d", resp.StatusCode)
+	}
+
+	resp := env.get(t, "/readyz")
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected /readyz to answer 200, got %d: %s", resp.StatusCode, body)
+	}
+	var report readinessReport
+	json.Unmarshal([]byte(body), &report)
+	for _, name := range []string{"redis", "ssh", "ssh_auth", "scripts_dir"} {
+		if report.Checks[name].Status != "ok" {
+			t.Errorf("expected %s check to pass, got %+v", name, report.Checks[name])
+		}
+	}
+	if cmds := env.vm.Commands(); len(cmds) != 1 || cmds[0] != "test -d '"+cfg.ScriptsDir+"'" {
+		t.Errorf("expected the scripts dir to be checked, got %q", cmds)
+	}
+}
+
+func TestReadinessWrongPassword(t *testing.T) {
+	env := newTestEnv(t)
+	cfg.VMPassword.Set("not-the-password")
+
+	resp := env.get(t, "/readyz")
+	var report readinessReport
+	json.Unmarshal([]byte(readBody(t, resp)), &report)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", resp.StatusCode)
+	}
+	if report.Checks["ssh_auth"].Status != "failed" || report.Checks["scripts_dir"].Status != "skipped" {
+		t.Errorf("expected ssh auth to fail, got %+v", report.Checks)
+	}
+}
+
+func TestTestSSHServerKeyAuth(t *testing.T) {
+	ts := newTestSSHServer(t)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+
+	config := &ssh.ClientConfig{
+		User:            ts.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	if _, err := ssh.Dial("tcp", ts.Addr, config); err == nil {
+		t.Fatal("expected an unknown key to be refused")
+	}
+
+	ts.authorize(signer.PublicKey())
+	ts.script("hello.sh", scriptResult{Stdout: "hi\n", Stderr: "warning\n"})
+	conn, err := ssh.Dial("tcp", ts.Addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sess, err := conn.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	out, err := sess.Output("'/bin/hello.sh'")
+	if err != nil || string(out) != "hi\n" || stderr.String() != "warning\n" {
+		t.Fatalf("expected the scripted output, got %q %q %v", out, stderr.String(), err)
+	}
+}
+
+func TestOperationRoutes(t *testing.T) {
+	env := newTestEnv(t)
+	dir := cfg.ScriptsDir
+	history := `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "alice", "Group": "g1", "Commit": "abc123"}]`
+	env.vm.script("gethistory.sh", scriptResult{Stdout: "Querying peer0\n" + history + "\n"})
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+
+	for _, tc := range []struct {
+		path string
+		body map[string]interface{}
+		cmd  string
+	}{
+		{"/test", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"},
+			`'` + dir + `/test.sh' 'alice' 'g1' 'abc123'`},
+		{"/init", map[string]interface{}{"Author": "vm-secret"},
+			`'` + dir + `/init.sh' 'vm-secret'`},
+		{"/creategroup", map[string]interface{}{"Author": "alice", "Group": "g1"},
+			`'` + dir + `/createchannel.sh' 'alice' 'g1'`},
+		{"/push", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"},
+			`'` + dir + `/push.sh' 'alice' 'g1' 'abc123'`},
+		{"/history", map[string]interface{}{"Group": "g1"},
+			`'` + dir + `/gethistory.sh' 'g1'`},
+		{"/clear", map[string]interface{}{"Author": "vm-secret"},
+			`'` + dir + `/clear.sh'`},
+	} {
+		reqID := "req" + strings.Replace(tc.path, "/", "-", -1)
+		resp := env.post(t, tc.path, reqID, tc.body)
+		body := readBody(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d: %s", tc.path, resp.StatusCode, body)
+			continue
+		}
+		if resp.Header.Get("X-Job-ID") == "" {
+			t.Errorf("%s: expected a job id", tc.path)
+		}
+
+		cmds := env.vm.Commands()
+		want := "REQUEST_ID='" + reqID + "' sudo " + tc.cmd
+		if cmds[len(cmds)-1] != want {
+			t.Errorf("%s: expected command %q, got %q", tc.path, want, cmds[len(cmds)-1])
+		}
+	}
+
+	// the history is returned raw and parsed
+	resp := env.post(t, "/history", "", map[string]interface{}{"Group": "g1"})
+	var result struct {
+		Response string
+		Result   []historyEntry
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if !strings.Contains(result.Response, "Querying peer0") || len(result.Result) != 1 || result.Result[0].Commit != "abc123" {
+		t.Errorf("unexpected history response %+v", result)
+	}
+
+	// clear flushed redis, only itself and the last history call are left
+	// in the audit log
+	if entries, _ := env.redis.List(auditKey); len(entries) != 2 {
+		t.Errorf("expected 2 audit entries, got %d", len(entries))
+	}
+}
+
+func TestOperationRejectedRequests(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp := env.post(t, "/init", "", map[string]interface{}{"Author": "alice"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a wrong password to be refused, got %d", resp.StatusCode)
+	}
+	resp = env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a missing commit to be refused, got %d", resp.StatusCode)
+	}
+	resp = env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1; reboot", "Commit": "abc"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an invalid group to be refused, got %d", resp.StatusCode)
+	}
+	if cmds := env.vm.Commands(); len(cmds) != 0 {
+		t.Errorf("expected no command to run, got %q", cmds)
+	}
+}
+
+func TestOperationScriptFailure(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("push.sh", scriptResult{Stdout: "Submitting\n", Stderr: "Error: endorsement failure\n", Status: 1})
+
+	sub, err := env.store.subscribe(context.Background(), eventsPrefix+"g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	resp := env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"})
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(body, "Can't run remote command") {
+		t.Fatalf("expected the failure to be reported, got %d: %s", resp.StatusCode, body)
+	}
+
+	var info jobInfo
+	json.NewDecoder(env.get(t, "/jobs/"+resp.Header.Get("X-Job-ID")).Body).Decode(&info)
+	if info.State != jobFailed {
+		t.Errorf("expected the job to have failed, got %+v", info)
+	}
+
+	// the failed push is not announced, the next event is the push that
+	// went through
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+	env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "def456"}).Body.Close()
+	select {
+	case payload := <-sub.C:
+		var ev groupEvent
+		if err := json.Unmarshal(payload, &ev); err != nil || ev.Type != eventPush || ev.Commit != "def456" {
+			t.Errorf("expected only the second push to be announced, got %s %v", payload, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the second push to be announced")
+	}
+}
+
+func TestOperationLockContention(t *testing.T) {
+	env := newTestEnv(t)
+	release := make(chan struct{})
+	env.vm.script("init.sh", scriptResult{Stdout: "Starting network\n", Wait: release})
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		done <- env.post(t, "/init", "", map[string]interface{}{"Author": "vm-secret"})
+	}()
+	waitFor(t, "init to start", func() bool { return len(env.vm.Commands()) == 1 })
+
+	resp := env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"})
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusInternalServerError || !strings.Contains(body, "Blockchain network being used") {
+		t.Fatalf("expected the push to be locked out, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp = env.get(t, "/readyz")
+	var report readinessReport
+	json.Unmarshal([]byte(readBody(t, resp)), &report)
+	if !report.Locked || !report.Locks.Global {
+		t.Errorf("expected the global lock to be reported, got %+v", report)
+	}
+
+	close(release)
+	if resp := <-done; resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected init to succeed, got %d", resp.StatusCode)
+	}
+	if len(env.vm.Commands()) != 2 {
+		t.Errorf("expected only init and the probe to run, got %q", env.vm.Commands())
+	}
+
+	resp = env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the push to run once the lock is released, got %d", resp.StatusCode)
+	}
+}
+
+func TestOperationScriptTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	cfg.ScriptTimeout = 50 * time.Millisecond
+	env.vm.script("test.sh", scriptResult{Wait: make(chan struct{})})
+
+	resp := env.post(t, "/test", "", map[string]interface{}{"Author": "alice"})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", resp.StatusCode)
+	}
+	waitFor(t, "the script to be signalled", func() bool { return len(env.vm.Signals()) == 1 })
+	if sig := env.vm.Signals()[0]; sig != string(ssh.SIGTERM) {
+		t.Errorf("expected SIGTERM, got %s", sig)
+	}
+}
+
+func TestJobRoutes(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("test.sh", scriptResult{Stdout: "line 1\nline 2\n", Stderr: "careful\n"})
+
+	resp := env.post(t, "/test", "", map[string]interface{}{"Author": "alice"})
+	readBody(t, resp)
+	id := resp.Header.Get("X-Job-ID")
+
+	var list []jobInfo
+	json.NewDecoder(env.get(t, "/jobs").Body).Decode(&list)
+	found := false
+	for _, info := range list {
+		found = found || info.ID == id
+	}
+	if !found {
+		t.Errorf("expected job %s to be listed, got %+v", id, list)
+	}
+
+	if resp := env.get(t, "/jobs/unknown"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", resp.StatusCode)
+	}
+
+	// jobs interrupted by an earlier shutdown are found in the store, an
+	// admin job for admins only
+	env.store.saveJob(context.Background(), jobInfo{ID: "old", Script: "init.sh", Role: roleAdmin, State: jobInterrupted})
+	if resp := env.get(t, "/jobs/old"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected an admin job to need the password, got %d", resp.StatusCode)
+	}
+	var info jobInfo
+	json.NewDecoder(env.admin(t, "/jobs/old").Body).Decode(&info)
+	if info.State != jobInterrupted || info.Script != "init.sh" {
+		t.Errorf("expected the interrupted job, got %+v", info)
+	}
+
+	// the output of admin operations is not listed to students
+	env.vm.script("init.sh", scriptResult{Stdout: "Network up\n"})
+	resp = env.post(t, "/init", "", map[string]interface{}{"Author": env.vm.Password})
+	readBody(t, resp)
+	initID := resp.Header.Get("X-Job-ID")
+	listed := func(path string, get func(*testing.T, string) *http.Response) bool {
+		var list []jobInfo
+		json.NewDecoder(get(t, path).Body).Decode(&list)
+		for _, info := range list {
+			if info.ID == initID {
+				return true
+			}
+		}
+		return false
+	}
+	if listed("/jobs", env.get) || !listed("/jobs", env.admin) {
+		t.Error("expected the init job to be listed to admins only")
+	}
+	if resp := env.get(t, "/jobs/"+initID+"/stream"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the init output to need the password, got %d", resp.StatusCode)
+	}
+	if stream := readBody(t, env.admin(t, "/jobs/"+initID+"/stream")); !strings.Contains(stream, "Network up") {
+		t.Errorf("expected admins to follow init, got %s", stream)
+	}
+
+	stream := readBody(t, env.get(t, "/jobs/"+id+"/stream"))
+	for _, want := range []string{"event: stdout\ndata: line 1", "event: stdout\ndata: line 2", "event: stderr\ndata: careful", "event: end"} {
+		if !strings.Contains(stream, want) {
+			t.Errorf("expected %q in the stream, got %s", want, stream)
+		}
+	}
+}
+
+func TestAsyncOperation(t *testing.T) {
+	env := newTestEnv(t)
+	wait := make(chan struct{})
+	env.vm.script("test.sh", scriptResult{Stdout: "line 1\n", Wait: wait})
+
+	// async posts to path without waiting for the script
+	async := func(path string, body interface{}) *http.Response {
+		t.Helper()
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest("POST", env.srv.URL+path, bytes.NewReader(data))
+		req.Header.Set("Prefer", "respond-async")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// answered while the script still runs
+	resp := async("/test", map[string]interface{}{"Author": "alice"})
+	var info jobInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	id := resp.Header.Get("X-Job-ID")
+	if resp.StatusCode != http.StatusAccepted || id == "" || resp.Header.Get("Location") != "/jobs/"+id || info.ID != id || info.State != jobRunning {
+		t.Fatalf("expected 202 with the running job, got %d %v %+v", resp.StatusCode, resp.Header, info)
+	}
+
+	close(wait)
+	waitFor(t, "the answer of the job", func() bool {
+		info = jobInfo{}
+		json.NewDecoder(env.get(t, "/jobs/"+id).Body).Decode(&info)
+		return info.Status != 0
+	})
+	if info.State != jobDone || info.Status != http.StatusOK || !strings.Contains(info.Answer, "line 1") {
+		t.Errorf("expected the answer of the operation, got %+v", info)
+	}
+
+	// refused before the script starts, answered as usual
+	resp = async("/clear", map[string]interface{}{"Author": "not the password"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a wrong password to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestCustomOperationRoutes(t *testing.T) {
+	env := newTestEnv(t)
+	reg, err := parseOperations([]byte(`[{"Name": "channels", "Script": "listchannels.sh", "Role": "admin", "Lock": "none"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := customOps.reg
+	customOps.reg = reg
+	defer func() { customOps.reg = old }()
+	env.vm.script("listchannels.sh", scriptResult{Stdout: "g1\ng2\n"})
+
+	var ops []operation
+	json.NewDecoder(env.get(t, "/ops").Body).Decode(&ops)
+	if len(ops) != 1 || ops[0].Name != "channels" {
+		t.Errorf("expected the custom operation to be listed, got %+v", ops)
+	}
+
+	if resp := env.post(t, "/ops/channels", "", map[string]interface{}{"Author": "alice"}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected students to be refused, got %d", resp.StatusCode)
+	}
+	resp := env.post(t, "/ops/channels", "", map[string]interface{}{"Author": "vm-secret"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || !strings.Contains(body, "g1\\ng2") {
+		t.Errorf("expected the channels, got %d: %s", resp.StatusCode, body)
+	}
+	if resp := env.post(t, "/ops/peers", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown operation, got %d", resp.StatusCode)
+	}
+}
+
+func TestUserRoutes(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp := env.post(t, "/registernumber", "", map[string]interface{}{"Author": "alice", "Group": "g1", "IP": "10.0.0.7"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+
+	var user map[string]string
+	resp = env.get(t, "/users/alice")
+	json.NewDecoder(resp.Body).Decode(&user)
+	if resp.StatusCode != http.StatusOK || user["Group"] != "g1" || user["IP"] != "10.0.0.7" {
+		t.Errorf("expected the registered user, got %d %v", resp.StatusCode, user)
+	}
+
+	if resp := env.get(t, "/users/bob"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown user, got %d", resp.StatusCode)
+	}
+}
+
+func TestGroupMembersRoute(t *testing.T) {
+	env := newTestEnv(t)
+	for _, author := range []string{"bob", "alice"} {
+		resp := env.post(t, "/creategroup", "", map[string]interface{}{"Author": author, "Group": "g1"})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected creategroup to succeed, got %d", resp.StatusCode)
+		}
+	}
+
+	var members []string
+	json.NewDecoder(env.get(t, "/groups/g1/members").Body).Decode(&members)
+	if len(members) != 2 || members[0] != "alice" || members[1] != "bob" {
+		t.Errorf("expected alice and bob, got %q", members)
+	}
+}
+
+func TestEventsRoute(t *testing.T) {
+	env := newTestEnv(t)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(env.srv.URL, "http")+"/events/g1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	resp := env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the push to succeed, got %d", resp.StatusCode)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var ev groupEvent
+	if err := ws.ReadJSON(&ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != eventPush || ev.Author != "alice" || ev.Commit != "abc123" {
+		t.Errorf("unexpected event %+v", ev)
+	}
 }
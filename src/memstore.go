@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memorySubBuffer is how many events a slow subscriber of the memory store
+// may lag behind before events are dropped for it
+const memorySubBuffer = 100
+
+// memoryStore keeps the data in process, for local work with no redis. It
+// is lost on restart and not shared between replicas.
+type memoryStore struct {
+	mu          sync.Mutex
+	users       map[string]map[string]string
+	keys        map[string][]byte
+	nonces      map[string]time.Time
+	enrolments  map[string]time.Time
+	memberships map[string]map[string]bool
+	commitMetas map[string]map[string]commitMetadata
+	lineages    map[string]map[string]commitNode
+	indexes     map[string]map[string]historyEntry
+	indexed     map[string]time.Time
+	failed      map[string]time.Time
+	hashes      map[string]map[hashOccurrence]bool
+	jobs        map[string]jobInfo
+	audits      []auditEntry
+	subs        map[string]map[chan []byte]bool
+}
+
+func newMemoryStore() *memoryStore {
+	ms := &memoryStore{subs: map[string]map[chan []byte]bool{}}
+	ms.reset()
+	return ms
+}
+
+// reset empties everything but the subscriptions, ms.mu must be held
+func (ms *memoryStore) reset() {
+	ms.users = map[string]map[string]string{}
+	ms.keys = map[string][]byte{}
+	ms.nonces = map[string]time.Time{}
+	ms.enrolments = map[string]time.Time{}
+	ms.memberships = map[string]map[string]bool{}
+	ms.commitMetas = map[string]map[string]commitMetadata{}
+	ms.lineages = map[string]map[string]commitNode{}
+	ms.indexes = map[string]map[string]historyEntry{}
+	ms.indexed = map[string]time.Time{}
+	ms.failed = map[string]time.Time{}
+	ms.hashes = map[string]map[hashOccurrence]bool{}
+	ms.jobs = map[string]jobInfo{}
+	ms.audits = nil
+}
+
+func (ms *memoryStore) saveUser(ctx context.Context, id string, fields map[string]interface{}) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user := ms.users[id]
+	if user == nil {
+		user = map[string]string{}
+		ms.users[id] = user
+	}
+	// stored as strings, as redis does
+	for k, v := range fields {
+		user[k] = fmt.Sprint(v)
+	}
+	return nil
+}
+
+func (ms *memoryStore) user(ctx context.Context, id string) (map[string]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	user := map[string]string{}
+	for k, v := range ms.users[id] {
+		user[k] = v
+	}
+	return user, nil
+}
+
+func (ms *memoryStore) setPublicKey(ctx context.Context, author string, key []byte, replace bool) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if _, ok := ms.keys[author]; ok && !replace {
+		return false, nil
+	}
+	ms.keys[author] = append([]byte(nil), key...)
+	return true, nil
+}
+
+func (ms *memoryStore) publicKey(ctx context.Context, author string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if key, ok := ms.keys[author]; ok {
+		return append([]byte(nil), key...), nil
+	}
+	return nil, nil
+}
+
+func (ms *memoryStore) addEnrolment(ctx context.Context, author, token string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.enrolments[author+"\n"+token] = time.Now().Add(ttl)
+	return nil
+}
+
+func (ms *memoryStore) useEnrolment(ctx context.Context, author, token string) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	id := author + "\n" + token
+	expires, ok := ms.enrolments[id]
+	delete(ms.enrolments, id)
+	return ok && time.Now().Before(expires), nil
+}
+
+func (ms *memoryStore) useNonce(ctx context.Context, author, nonce string, ttl time.Duration) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	// forget the expired nonces as new ones come
+	for n, expires := range ms.nonces {
+		if now.After(expires) {
+			delete(ms.nonces, n)
+		}
+	}
+	id := author + "\n" + nonce
+	if _, used := ms.nonces[id]; used {
+		return false, nil
+	}
+	ms.nonces[id] = now.Add(ttl)
+	return true, nil
+}
+
+func (ms *memoryStore) forgetNonce(ctx context.Context, author, nonce string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.nonces, author+"\n"+nonce)
+	return nil
+}
+
+func (ms *memoryStore) addMember(ctx context.Context, group, author string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.memberships[group] == nil {
+		ms.memberships[group] = map[string]bool{}
+	}
+	ms.memberships[group][author] = true
+	return nil
+}
+
+func (ms *memoryStore) members(ctx context.Context, group string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	members := []string{}
+	for m := range ms.memberships[group] {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (ms *memoryStore) groups(ctx context.Context) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	groups := []string{}
+	for g := range ms.memberships {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func (ms *memoryStore) saveCommit(ctx context.Context, group, commit string, meta commitMetadata) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.commitMetas[group] == nil {
+		ms.commitMetas[group] = map[string]commitMetadata{}
+	}
+	ms.commitMetas[group][commit] = meta
+	return nil
+}
+
+func (ms *memoryStore) commits(ctx context.Context, group string, hashes []string) (map[string]commitMetadata, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	metas := map[string]commitMetadata{}
+	for _, h := range hashes {
+		if meta, ok := ms.commitMetas[group][h]; ok {
+			metas[h] = meta
+		}
+	}
+	return metas, nil
+}
+
+func (ms *memoryStore) indexCommits(ctx context.Context, group string, entries []historyEntry, complete bool) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if complete || ms.indexes[group] == nil {
+		ms.indexes[group] = map[string]historyEntry{}
+	}
+	for c, e := range firstPushes(entries) {
+		if _, ok := ms.indexes[group][c]; !ok {
+			ms.indexes[group][c] = e
+		}
+	}
+	if complete {
+		ms.indexed[group] = time.Now()
+	}
+	return nil
+}
+
+func (ms *memoryStore) indexedCommit(ctx context.Context, group, hash string) (historyEntry, bool, time.Time, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	e, ok := ms.indexes[group][hash]
+	refreshed := ms.indexed[group]
+	if failed, ok := ms.failed[group]; ok && failed.After(refreshed) {
+		refreshed = failed
+	}
+	return e, ok, refreshed, nil
+}
+
+func (ms *memoryStore) failRefresh(ctx context.Context, group string, ttl time.Duration) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// forget the expired failures as new ones come, like the nonces
+	now := time.Now()
+	for g, failed := range ms.failed {
+		if now.Sub(failed) > ttl {
+			delete(ms.failed, g)
+		}
+	}
+	ms.failed[group] = now
+	return nil
+}
+
+func (ms *memoryStore) indexHashes(ctx context.Context, occs map[string][]hashOccurrence) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for h, list := range occs {
+		if ms.hashes[h] == nil {
+			ms.hashes[h] = map[hashOccurrence]bool{}
+		}
+		for _, o := range list {
+			ms.hashes[h][o] = true
+		}
+	}
+	return nil
+}
+
+// matches returns the sorted hashes keep accepts with their occurrences of
+// kind, any when empty, up to limit, ms.mu must be held
+func (ms *memoryStore) matches(kind string, limit int, keep func(hashMatch) bool) []hashMatch {
+	hashes := make([]string, 0, len(ms.hashes))
+	for h := range ms.hashes {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	var matches []hashMatch
+	for _, h := range hashes {
+		m := hashMatch{Hash: h}
+		for o := range ms.hashes[h] {
+			if kind == "" || o.Kind == kind {
+				m.Occurrences = append(m.Occurrences, o)
+			}
+		}
+		if len(m.Occurrences) == 0 || !keep(m) {
+			continue
+		}
+		sortOccurrences(m.Occurrences)
+		if matches = append(matches, m); len(matches) == limit {
+			break
+		}
+	}
+	return matches
+}
+
+func (ms *memoryStore) searchHashes(ctx context.Context, prefix, kind string, limit int) ([]hashMatch, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.matches(kind, limit, func(m hashMatch) bool { return strings.HasPrefix(m.Hash, prefix) }), nil
+}
+
+func (ms *memoryStore) sharedHashes(ctx context.Context, kind string, limit int) ([]hashMatch, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.matches(kind, limit, func(m hashMatch) bool { return m.groups() > 1 }), nil
+}
+
+func (ms *memoryStore) lineage(ctx context.Context, group string) (map[string]commitNode, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	nodes := map[string]commitNode{}
+	for c, n := range ms.lineages[group] {
+		nodes[c] = n
+	}
+	return nodes, nil
+}
+
+func (ms *memoryStore) addCommitNode(ctx context.Context, group string, node commitNode, strict bool) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.lineages[group] == nil {
+		ms.lineages[group] = map[string]commitNode{}
+	}
+	node.Flags = lineageFlags(ms.lineages[group], node)
+	if strict && node.Flags != nil {
+		return node.Flags, nil
+	}
+	if _, dup := ms.lineages[group][node.Commit]; !dup {
+		ms.lineages[group][node.Commit] = node
+	}
+	return node.Flags, nil
+}
+
+func (ms *memoryStore) removeCommitNode(ctx context.Context, group, commit string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.lineages[group], commit)
+	return nil
+}
+
+func (ms *memoryStore) saveJob(ctx context.Context, info jobInfo) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.jobs[info.ID] = info
+	return nil
+}
+
+func (ms *memoryStore) job(ctx context.Context, id string) (jobInfo, bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	info, ok := ms.jobs[id]
+	return info, ok, nil
+}
+
+func (ms *memoryStore) audit(ctx context.Context, e auditEntry) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.audits = append(ms.audits, e)
+	if len(ms.audits) > maxAuditEntries {
+		ms.audits = ms.audits[len(ms.audits)-maxAuditEntries:]
+	}
+	return nil
+}
+
+func (ms *memoryStore) auditLog(ctx context.Context, n int) ([]auditEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entries := []auditEntry{}
+	for i := len(ms.audits) - 1; i >= 0 && len(entries) < n; i-- {
+		entries = append(entries, ms.audits[i])
+	}
+	return entries, nil
+}
+
+// publish never blocks, a subscriber too slow to keep up misses events
+func (ms *memoryStore) publish(ctx context.Context, channel string, payload []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for c := range ms.subs[channel] {
+		select {
+		case c <- payload:
+		default:
+		}
+	}
+	return nil
+}
+
+func (ms *memoryStore) subscribe(ctx context.Context, channels ...string) (*subscription, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	c := make(chan []byte, memorySubBuffer)
+	for _, ch := range channels {
+		if ms.subs[ch] == nil {
+			ms.subs[ch] = map[chan []byte]bool{}
+		}
+		ms.subs[ch][c] = true
+	}
+
+	var once sync.Once
+	return &subscription{C: c, close: func() error {
+		once.Do(func() {
+			ms.mu.Lock()
+			defer ms.mu.Unlock()
+			for _, ch := range channels {
+				delete(ms.subs[ch], c)
+			}
+			close(c)
+		})
+		return nil
+	}}, nil
+}
+
+func (ms *memoryStore) clear(ctx context.Context) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.reset()
+	return nil
+}
+
+// ready has nothing to check, the memory store is always there
+func (ms *memoryStore) ready(ctx context.Context, checks map[string]checkResult) {
+}
+
+func (ms *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultOperations maps the API to the bloc-server commands when no
+// operations file is configured
+//
+//go:embed conf/operations.json
+var defaultOperations []byte
+
+// roles an operation can require
+const (
+	roleStudent = "student"
+	roleAdmin   = "admin"
+)
+
+// output parsers, the parsed output is returned next to the raw one
+const (
+	outputRaw     = "raw"
+	outputLines   = "lines"
+	outputJSON    = "json"
+	outputHistory = "history"
+)
+
+// argTypes are the accepted argument types and the values they allow, every
+// argument is quoted for the shell whatever its type
+var argTypes = map[string]*regexp.Regexp{
+	"string": nil,
+	"name":   regexp.MustCompile(`^[A-Za-z0-9_.-]+$`),
+	"hash":   regexp.MustCompile(`^[0-9a-fA-F]{4,128}$`),
+	"int":    regexp.MustCompile(`^-?[0-9]+$`),
+	"bool":   regexp.MustCompile(`^(true|false)$`),
+}
+
+// opNamePattern keeps operation names usable as a route
+var opNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// reservedRoutes can't be taken by an operation
+var reservedRoutes = map[string]bool{
+	"healthz": true, "readyz": true, "jobs": true, "users": true,
+	"events": true, "registernumber": true, "groups": true, "audit": true,
+	"dashboard": true, "receipts": true, "search": true, "duplicates": true,
+	"export": true,
+}
+
+// duration reads "90s" style durations from json
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	d.Duration = v
+	return err
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// argSpec describes one argument of a script, taken from the request body
+// field of the same name
+type argSpec struct {
+	Name     string
+	Type     string `json:",omitempty"`
+	Required bool   `json:",omitempty"`
+	// Pattern further restricts the value, as a regular expression
+	Pattern string `json:",omitempty"`
+
+	re *regexp.Regexp
+}
+
+// operation maps an API action to a bloc-server script
+type operation struct {
+	Name string
+	// Script is relative to the scripts directory unless absolute
+	Script string
+	Args   []argSpec `json:",omitempty"`
+	Role   string
+	Lock   string
+	// Timeout overrides the configured timeout of the script
+	Timeout duration `json:",omitempty"`
+	Output  string
+}
+
+// registry holds the operations in the order they were defined
+type registry struct {
+	ops    []*operation
+	byName map[string]*operation
+}
+
+// loadOperations reads the operations from file, or the built in ones if
+// file is empty
+func loadOperations(file string) (*registry, error) {
+	data := defaultOperations
+	if file != "" {
+		var err error
+		if data, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	reg, err := parseOperations(data)
+	if err != nil && file != "" {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return reg, err
+}
+
+// parseOperations decodes and validates a json list of operations
+func parseOperations(data []byte) (*registry, error) {
+	var ops []*operation
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ops); err != nil {
+		return nil, err
+	}
+
+	reg := &registry{byName: map[string]*operation{}}
+	for _, op := range ops {
+		if err := op.validate(); err != nil {
+			return nil, err
+		}
+		if reg.byName[op.Name] != nil {
+			return nil, fmt.Errorf("operation %q defined twice", op.Name)
+		}
+		reg.ops = append(reg.ops, op)
+		reg.byName[op.Name] = op
+	}
+	return reg, nil
+}
+
+// validate checks op and fills in the defaults
+func (op *operation) validate() error {
+	if !opNamePattern.MatchString(op.Name) || reservedRoutes[op.Name] {
+		return fmt.Errorf("invalid operation name %q", op.Name)
+	}
+	if op.Script == "" {
+		return fmt.Errorf("operation %s: script is required", op.Name)
+	}
+
+	if op.Role == "" {
+		op.Role = roleAdmin
+	}
+	if op.Role != roleAdmin && op.Role != roleStudent {
+		return fmt.Errorf("operation %s: unknown role %q", op.Name, op.Role)
+	}
+
+	if op.Lock == "" {
+		op.Lock = lockGlobal
+	}
+	switch op.Lock {
+	case lockGlobal, lockNone:
+	case lockGroup:
+		if op.arg("Group") == nil {
+			return fmt.Errorf("operation %s: group lock needs a Group argument", op.Name)
+		}
+	default:
+		return fmt.Errorf("operation %s: unknown lock scope %q", op.Name, op.Lock)
+	}
+
+	if op.Output == "" {
+		op.Output = outputRaw
+	}
+	switch op.Output {
+	case outputRaw, outputLines, outputJSON, outputHistory:
+	default:
+		return fmt.Errorf("operation %s: unknown output parser %q", op.Name, op.Output)
+	}
+
+	if op.Timeout.Duration < 0 {
+		return fmt.Errorf("operation %s: timeout can't be negative", op.Name)
+	}
+
+	for i, name := range hookedArgs[op.scriptName()] {
+		if i >= len(op.Args) || op.Args[i].Name != name {
+			return fmt.Errorf("operation %s: %s takes %s as its first arguments", op.Name, op.scriptName(), strings.Join(hookedArgs[op.scriptName()], ", "))
+		}
+	}
+
+	for i := range op.Args {
+		a := &op.Args[i]
+		if a.Type == "" {
+			a.Type = "string"
+		}
+		if _, ok := argTypes[a.Type]; !ok {
+			return fmt.Errorf("operation %s: argument %s has unknown type %q", op.Name, a.Name, a.Type)
+		}
+		if a.Pattern != "" {
+			re, err := regexp.Compile(a.Pattern)
+			if err != nil {
+				return fmt.Errorf("operation %s: argument %s: %v", op.Name, a.Name, err)
+			}
+			a.re = re
+		}
+	}
+	return nil
+}
+
+// arg returns the argument called name, if any
+func (op *operation) arg(name string) *argSpec {
+	for i := range op.Args {
+		if op.Args[i].Name == name {
+			return &op.Args[i]
+		}
+	}
+	return nil
+}
+
+// scriptName is the base name of the script, as used for the timeouts
+func (op *operation) scriptName() string {
+	return path.Base(op.Script)
+}
+
+// scriptPath is where the script lives on the VM
+func (op *operation) scriptPath() string {
+	if path.IsAbs(op.Script) {
+		return op.Script
+	}
+	return path.Join(cfg.ScriptsDir, op.Script)
+}
+
+// timeout returns how long the script may run: the global override, then
+// the timeout of the operation, then the one configured for the script
+func (op *operation) timeout() time.Duration {
+	if cfg.ScriptTimeout > 0 {
+		return cfg.ScriptTimeout
+	}
+	if op.Timeout.Duration > 0 {
+		return op.Timeout.Duration
+	}
+	return scriptTimeout(op.scriptName())
+}
+
+// bindArgs takes the arguments of op from a request body and validates them
+func (op *operation) bindArgs(body map[string]interface{}) ([]string, error) {
+	args := make([]string, len(op.Args))
+	for i, a := range op.Args {
+		var v string
+		switch raw := body[a.Name].(type) {
+		case nil:
+		case string:
+			v = raw
+		case float64:
+			v = strconv.FormatFloat(raw, 'f', -1, 64)
+		case bool:
+			v = strconv.FormatBool(raw)
+		default:
+			return nil, fmt.Errorf("%s must be a %s", a.Name, a.Type)
+		}
+
+		if v == "" {
+			if a.Required {
+				return nil, fmt.Errorf("%s is required", a.Name)
+			}
+			continue
+		}
+		if re := argTypes[a.Type]; re != nil && !re.MatchString(v) {
+			return nil, fmt.Errorf("%s must be a %s", a.Name, a.Type)
+		}
+		if a.re != nil && !a.re.MatchString(v) {
+			return nil, fmt.Errorf("%s doesn't match %s", a.Name, a.Pattern)
+		}
+		args[i] = v
+	}
+
+	// optional arguments left out at the end are not passed at all, like
+	// they used to be when the command line was concatenated
+	for len(args) > 0 && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	return args, nil
+}
+
+// command is the command line running op with args on the VM. The request
+// id is handed to the script so its output can be matched with our logs.
+// It is set in the environment of sudo rather than on its command line,
+// which sudoers refuses under env_reset; the VM keeps it with env_keep.
+func (op *operation) command(args []string, reqID string) string {
+	var parts []string
+	if reqID != "" {
+		parts = append(parts, "REQUEST_ID="+shellQuote(reqID))
+	}
+	parts = append(parts, "sudo", shellQuote(op.scriptPath()))
+	for _, a := range args {
+		parts = append(parts, shellQuote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// parseOutput runs the output parser of op
+func (op *operation) parseOutput(out []byte) (interface{}, error) {
+	switch op.Output {
+	case outputLines:
+		lines := []string{}
+		for _, l := range strings.Split(string(out), "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				lines = append(lines, l)
+			}
+		}
+		return lines, nil
+	case outputJSON:
+		i := bytes.IndexAny(out, "[{")
+		if i < 0 {
+			return nil, fmt.Errorf("no json in script output")
+		}
+		var v interface{}
+		err := json.NewDecoder(bytes.NewReader(out[i:])).Decode(&v)
+		return v, err
+	case outputHistory:
+		return parseHistory(string(out))
+	}
+	return nil, nil
+}
+
+// opHooks are the side effects of an operation besides its script
+type opHooks struct {
+	// check validates the request body beyond the arguments and may
+	// complete cp, a failure answers 400
+	check  func(body []byte, cp *ContentPost) error
+	before func(ctx context.Context, cp ContentPost) error
+	// result runs once the script succeeded, before the answer is written.
+	// It may complete the answer.
+	result func(ctx context.Context, cp ContentPost, resp *scriptResponse)
+	after  func(ctx context.Context, cp ContentPost, out []byte)
+	// undo gives back what before took when the script never started, the
+	// network being busy or out of reach
+	undo func(ctx context.Context, cp ContentPost)
+	// failed gives back what before reserved when the script didn't
+	// succeed, whether it started or not
+	failed func(ctx context.Context, cp ContentPost)
+}
+
+// opHandler serves every operation of the registry
+type opHandler struct {
+	uh userHandler
+	// hooks are by script, so whatever operation runs a script, renamed or
+	// custom, keeps the server state in step with it
+	hooks map[string]opHooks
+}
+
+// hookedArgs are the arguments the hooks of a script read from the body,
+// which an operation running that script must pass it first, in order, so
+// the hooks check what the script gets
+var hookedArgs = map[string][]string{
+	"createchannel.sh": {"Author", "Group"},
+	"gethistory.sh":    {"Group"},
+	"push.sh":          {"Author", "Group", "Commit"},
+}
+
+func newOpHandler(st store) opHandler {
+	uh := userHandler{store: st}
+	return opHandler{uh: uh, hooks: map[string]opHooks{
+		"clear.sh": {
+			before: func(ctx context.Context, cp ContentPost) error {
+				return st.clear(ctx)
+			},
+			after: func(ctx context.Context, cp ContentPost, out []byte) {
+				uh.publish(ctx, groupEvent{Type: eventNetworkCleared})
+			},
+		},
+		"createchannel.sh": {
+			after: func(ctx context.Context, cp ContentPost, out []byte) {
+				if err := st.addMember(ctx, cp.Group, cp.Author); err != nil {
+					loggerFrom(ctx).Warn("failed to record group member", "group", cp.Group, "error", err)
+				}
+				uh.publish(ctx, groupEvent{Type: eventMemberJoined, Group: cp.Group, Author: cp.Author})
+			},
+		},
+		"gethistory.sh": {
+			result: func(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+				uh.indexHistory(ctx, cp, resp)
+				uh.indexHistoryHashes(ctx, cp, resp)
+				uh.mergeCommits(ctx, cp, resp)
+			},
+		},
+		"push.sh": {
+			check: checkPush,
+			before: func(ctx context.Context, cp ContentPost) error {
+				if err := uh.verifyPush(ctx, cp); err != nil {
+					return err
+				}
+				if err := uh.reserveLineage(ctx, cp); err != nil {
+					uh.releaseNonce(ctx, cp)
+					return err
+				}
+				return nil
+			},
+			undo:   uh.releaseNonce,
+			failed: uh.releaseLineage,
+			result: func(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+				uh.saveCommit(ctx, cp, resp)
+				uh.recordLineage(ctx, cp, resp)
+				uh.indexPush(ctx, cp, resp)
+				uh.indexPushHashes(ctx, cp, resp)
+				issueReceipt(ctx, cp, resp)
+			},
+			after: func(ctx context.Context, cp ContentPost, out []byte) {
+				uh.publish(ctx, groupEvent{Type: eventPush, Group: cp.Group, Author: cp.Author, Commit: cp.Commit})
+			},
+		},
+	}}
+}
+
+// isAdmin tells if the request body carries the admin password, which the
+// clients send as the Author
+func isAdmin(body map[string]interface{}) bool {
+	password, _ := body["Author"].(string)
+	return password != "" && password == cfg.VMPassword.Get()
+}
+
+// adminPasswordHeader carries the admin password on the GET routes, which
+// have no body
+const adminPasswordHeader = "X-Admin-Password"
+
+// isAdminRequest tells if r carries the admin password in its header
+func isAdminRequest(r *http.Request) bool {
+	password := r.Header.Get(adminPasswordHeader)
+	return password != "" && password == cfg.VMPassword.Get()
+}
+
+// serve returns the handler of a built in operation
+func (oh opHandler) serve(op *operation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		oh.run(w, r, op, oh.hooks[op.scriptName()])
+	}
+}
+
+// run runs op for r, answering once it is over or, when the client prefers
+// it, as soon as its script started
+func (oh opHandler) run(w http.ResponseWriter, r *http.Request, op *operation, hooks opHooks) {
+	if preferAsync(r) {
+		oh.runAsync(w, r, op, hooks)
+		return
+	}
+	oh.execute(w, r, op, hooks)
+}
+
+// execute checks the role, validates the arguments, runs the script and
+// returns its raw and parsed output. Every call is audited, whatever its
+// outcome.
+func (oh opHandler) execute(w http.ResponseWriter, r *http.Request, op *operation, hooks opHooks) {
+	l := loggerFrom(r.Context()).With("operation", op.Name)
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	entry := auditEntry{RequestID: requestID(r.Context()), Identity: identity(r.Context()), Operation: op.Name, Role: roleStudent}
+	defer func() {
+		entry.Status = rec.status
+		entry.JobID = w.Header().Get("X-Job-ID")
+		entry.DurationMs = time.Since(start).Milliseconds()
+		oh.uh.audit(r.Context(), entry)
+	}()
+	fail := func(msg string, status int) {
+		entry.Error = msg
+		http.Error(w, msg, status)
+	}
+
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		fail(err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := map[string]interface{}{}
+	if len(bytes.TrimSpace(reqBody)) > 0 {
+		if err := json.Unmarshal(reqBody, &body); err != nil {
+			fail(err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var cp ContentPost
+	json.Unmarshal(reqBody, &cp)
+
+	// the admins send their password as the Author, it never goes in the
+	// audit log
+	group, _ := body["Group"].(string)
+	entry.Group = group
+	if isAdmin(body) {
+		entry.Role = roleAdmin
+	} else {
+		entry.Author = cp.Author
+	}
+
+	if op.Role == roleAdmin && entry.Role != roleAdmin {
+		l.Warn("wrong admin password", "path", r.URL.Path)
+		entry.Author = ""
+		fail("Wrong Password", http.StatusForbidden)
+		return
+	}
+
+	args, err := op.bindArgs(body)
+	if err != nil {
+		fail(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if hooks.check != nil {
+		if err := hooks.check(reqBody, &cp); err != nil {
+			fail(err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if hooks.before != nil {
+		if err := hooks.before(r.Context(), cp); err != nil {
+			entry.Error = err.Error()
+			writeScriptError(w, err)
+			return
+		}
+	}
+
+	started := false
+	ctx := onJobStart(r.Context(), func(*job) { started = true })
+	results, err := runScript(ctx, w, op, args, group)
+	if err != nil {
+		if !started && hooks.undo != nil {
+			hooks.undo(r.Context(), cp)
+		}
+		if hooks.failed != nil {
+			hooks.failed(r.Context(), cp)
+		}
+		entry.Error = err.Error()
+		writeScriptError(w, err)
+		return
+	}
+
+	// convert results into string and populate an instance of
+	// the scriptResponse struct
+	response := scriptResponse{Response: string(results)}
+	if parsed, err := op.parseOutput(results); err != nil {
+		l.Warn("can't parse script output", "parser", op.Output, "error", err)
+	} else {
+		response.Result = parsed
+	}
+	if hooks.result != nil {
+		hooks.result(r.Context(), cp, &response)
+	}
+
+	// encode response into JSON and deliver back to user
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		l.Warn("can't return remote command output", "error", err)
+	}
+
+	if hooks.after != nil {
+		hooks.after(r.Context(), cp, results)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultOperations(t *testing.T) {
+	reg, err := loadOperations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, script := range map[string]string{
+		"test": "test.sh", "init": "init.sh", "clear": "clear.sh",
+		"history": "gethistory.sh", "creategroup": "createchannel.sh", "push": "push.sh",
+	} {
+		op := reg.byName[name]
+		if op == nil {
+			t.Errorf("missing operation %s", name)
+			continue
+		}
+		if op.Script != script {
+			t.Errorf("expected %s to run %s, got %s", name, script, op.Script)
+		}
+	}
+	if reg.byName["init"].Role != roleAdmin || reg.byName["push"].Role != roleStudent {
+		t.Error("unexpected roles")
+	}
+	if reg.byName["history"].Output != outputHistory {
+		t.Error("expected history to be parsed")
+	}
+}
+
+func TestOperationCommand(t *testing.T) {
+	reg, err := parseOperations([]byte(`[{
+		"Name": "push", "Script": "push.sh", "Role": "student",
+		"Args": [
+			{"Name": "Author", "Required": true},
+			{"Name": "Group", "Type": "name", "Required": true},
+			{"Name": "Commit"},
+			{"Name": "Note"}
+		]
+	}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := reg.byName["push"]
+
+	args, err := op.bindArgs(map[string]interface{}{"Author": "o'brien; rm -rf /", "Group": "g1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 {
+		t.Fatalf("expected trailing optional arguments to be dropped, got %q", args)
+	}
+
+	cmd := op.command(args, "req-1")
+	want := `REQUEST_ID='req-1' sudo '` + cfg.ScriptsDir + `/push.sh' 'o'"'"'brien; rm -rf /' 'g1'`
+	if cmd != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, cmd)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"Group": "g1"},
+		{"Author": "a", "Group": "g 1"},
+		{"Author": "a", "Group": []interface{}{"g1"}},
+	} {
+		if _, err := op.bindArgs(body); err == nil {
+			t.Errorf("expected %v to be rejected", body)
+		}
+	}
+}
+
+func TestOperationValidation(t *testing.T) {
+	for _, def := range []string{
+		`[{"Name": "jobs", "Script": "x.sh"}]`,
+		`[{"Name": "x", "Script": ""}]`,
+		`[{"Name": "x", "Script": "x.sh", "Role": "teacher"}]`,
+		`[{"Name": "x", "Script": "x.sh", "Lock": "group"}]`,
+		`[{"Name": "x", "Script": "x.sh", "Output": "xml"}]`,
+		`[{"Name": "x", "Script": "x.sh", "Args": [{"Name": "A", "Type": "float"}]}]`,
+		`[{"Name": "x", "Script": "x.sh", "Scirpt": "typo"}]`,
+		`[{"Name": "x", "Script": "x.sh"}, {"Name": "x", "Script": "y.sh"}]`,
+		`[{"Name": "x", "Script": "push.sh", "Args": [{"Name": "Author"}, {"Name": "Group"}, {"Name": "Hash"}]}]`,
+		`[{"Name": "x", "Script": "/opt/bin/gethistory.sh"}]`,
+	} {
+		if _, err := parseOperations([]byte(def)); err == nil {
+			t.Errorf("expected %s to be rejected", def)
+		}
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	oldCfg := cfg
+	cfg = defaultConfig()
+	defer func() { cfg = oldCfg }()
+
+	reg, err := parseOperations([]byte(`[
+		{"Name": "push", "Script": "push.sh", "Args": [{"Name": "Author"}, {"Name": "Group"}, {"Name": "Commit"}]},
+		{"Name": "slow", "Script": "/opt/slow.sh", "Timeout": "20m"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := reg.byName["push"].timeout(); got != 2*time.Minute {
+		t.Errorf("expected configured push.sh timeout, got %s", got)
+	}
+	if got := reg.byName["slow"].timeout(); got != 20*time.Minute {
+		t.Errorf("expected operation timeout, got %s", got)
+	}
+	if got := reg.byName["slow"].scriptPath(); got != "/opt/slow.sh" {
+		t.Errorf("expected absolute script path to be kept, got %s", got)
+	}
+}
+
+func TestParseOutput(t *testing.T) {
+	op := &operation{Output: outputJSON}
+	v, err := op.parseOutput([]byte("peer log line\n{\"channels\": [\"g1\"]}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Replace(toJSON(t, v), " ", "", -1), `"channels":["g1"]`) {
+		t.Errorf("unexpected json result %v", v)
+	}
+
+	op.Output = outputLines
+	v, _ = op.parseOutput([]byte("a\n\n  b \n"))
+	if lines := v.([]string); len(lines) != 2 || lines[1] != "b" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// receiptSigningDomain starts every signed receipt, see pushSigningDomain
+const receiptSigningDomain = "gatherchain-receipt/v1"
+
+// txIDPattern finds the transaction id in the output of push.sh, as logged
+// by the peer ("txid [...]") or the simulator ("transaction ...")
+var txIDPattern = regexp.MustCompile(`(?i)\b(?:txid|tx_id|transaction(?: id)?)\b[\s:=\[]*([0-9a-f]{16,128})\b`)
+
+// pushTxID returns the transaction id in the output of push.sh, "" if
+// there is none
+func pushTxID(output string) string {
+	if m := txIDPattern.FindStringSubmatch(output); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return ""
+}
+
+// receipt is the proof, signed by the server, that a push was accepted
+type receipt struct {
+	Group  string
+	Commit string
+	Author string
+	TxID   string `json:",omitempty"`
+	// Time is when the server accepted the push, RFC 3339
+	Time string
+	// KeyID names the server key that signed, see receiptSigner
+	KeyID     string
+	Signature string
+}
+
+// payload returns the bytes the server signs for rc: its fields in json, so
+// no value can spill into the next one
+func (rc receipt) payload() []byte {
+	data, _ := json.Marshal(struct {
+		Domain, Group, Commit, Author, TxID, Time, KeyID string
+	}{receiptSigningDomain, rc.Group, rc.Commit, rc.Author, rc.TxID, rc.Time, rc.KeyID})
+	return data
+}
+
+// checkPrintable refuses control characters in the fields a receipt
+// carries
+func checkPrintable(fields map[string]string) error {
+	for name, v := range fields {
+		if strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%s can't hold control characters", name)
+		}
+	}
+	return nil
+}
+
+// receiptSigner holds the key of the server, read from ReceiptKeyFile so
+// receipts verify across restarts and on every replica
+type receiptSigner struct {
+	mu  sync.Mutex
+	key ed25519.PrivateKey
+	id  string
+}
+
+var receipts = &receiptSigner{}
+
+// keyID is the first bytes of the hash of a public key, in hex
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// load reads the key of c, a PKCS #8 Ed25519 key in PEM as written by
+// "openssl genpkey -algorithm ed25519". A missing file is generated, the
+// replicas must then be given a copy.
+func (rs *receiptSigner) load(c *config) error {
+	if c.ReceiptKeyFile == "" {
+		return fmt.Errorf("receiptkeyfile is needed, receipts must verify after a restart")
+	}
+	data, err := ioutil.ReadFile(c.ReceiptKeyFile)
+	if os.IsNotExist(err) {
+		data, err = generateReceiptKey(c.ReceiptKeyFile)
+	}
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM block found", c.ReceiptKeyFile)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.ReceiptKeyFile, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: not an Ed25519 key", c.ReceiptKeyFile)
+	}
+
+	rs.mu.Lock()
+	rs.key, rs.id = key, keyID(key.Public().(ed25519.PublicKey))
+	rs.mu.Unlock()
+	return nil
+}
+
+// generateReceiptKey writes a new key to file and returns it, or the key
+// another process wrote first
+func generateReceiptKey(file string) ([]byte, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(file)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(file)
+		return nil, err
+	}
+	logger.Warn("generated the receipt key, give the other replicas a copy", "file", file, "key_id", keyID(key.Public().(ed25519.PublicKey)))
+	return data, nil
+}
+
+// errNoReceiptKey is returned until load read the key
+var errNoReceiptKey = fmt.Errorf("no receipt key loaded")
+
+// current returns the key loaded by load
+func (rs *receiptSigner) current() (ed25519.PrivateKey, string, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.key == nil {
+		return nil, "", errNoReceiptKey
+	}
+	return rs.key, rs.id, nil
+}
+
+// sign fills in the key id and signature of rc
+func (rs *receiptSigner) sign(rc *receipt) error {
+	key, id, err := rs.current()
+	if err != nil {
+		return err
+	}
+	rc.KeyID = id
+	rc.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, rc.payload()))
+	return nil
+}
+
+// verify tells why rc was not signed by the key of the server, nil if it was
+func (rs *receiptSigner) verify(rc receipt) error {
+	key, id, err := rs.current()
+	if err != nil {
+		return err
+	}
+	if rc.KeyID != id {
+		return fmt.Errorf("signed by key %q, the server key is %q", rc.KeyID, id)
+	}
+	sig, err := base64.StdEncoding.DecodeString(rc.Signature)
+	if err != nil {
+		return fmt.Errorf("Signature must be base64")
+	}
+	if !ed25519.Verify(key.Public().(ed25519.PublicKey), rc.payload(), sig) {
+		return fmt.Errorf("signature doesn't match the receipt")
+	}
+	return nil
+}
+
+// issueReceipt answers a successful push with a signed receipt
+func issueReceipt(ctx context.Context, cp ContentPost, resp *scriptResponse) {
+	rc := receipt{
+		Group:  cp.Group,
+		Commit: cp.Commit,
+		Author: cp.Author,
+		TxID:   pushTxID(resp.Response),
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if err := receipts.sign(&rc); err != nil {
+		// the push is on chain, it is answered without a receipt
+		loggerFrom(ctx).Error("can't sign the receipt", "group", cp.Group, "commit", cp.Commit, "error", err)
+		return
+	}
+	resp.Receipt = &rc
+}
+
+// receiptKey is the json view of the server key
+type receiptKey struct {
+	Algorithm string
+	KeyID     string
+	PublicKey string
+}
+
+// getReceiptKey publishes the key receipts are signed with
+func getReceiptKey(w http.ResponseWriter, r *http.Request) {
+	key, id, err := receipts.current()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receiptKey{
+		Algorithm: "Ed25519",
+		KeyID:     id,
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	})
+}
+
+// receiptCheck is the answer of POST /receipts/verify
+type receiptCheck struct {
+	Valid bool
+	Error string `json:",omitempty"`
+}
+
+// verifyReceipt tells if the receipt in the body was signed by the server
+func verifyReceipt(w http.ResponseWriter, r *http.Request) {
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rc receipt
+	if err := json.Unmarshal(reqBody, &rc); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkPrintable(map[string]string{"Group": rc.Group, "Commit": rc.Commit, "Author": rc.Author}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	check := receiptCheck{Valid: true}
+	if err := receipts.verify(rc); err != nil {
+		check = receiptCheck{Error: err.Error()}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(check)
+}
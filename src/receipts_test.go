@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestTxIDPattern(t *testing.T) {
+	for output, want := range map[string]string{
+		"Commit abc pushed to channel 'g1', transaction 9f86d081884c7d65\n":                          "9f86d081884c7d65",
+		"2021-03-01 INFO [chaincodeCmd] txid [4C1F2E3D4A5B6C7D8E9F] committed with status (VALID)\n": "4C1F2E3D4A5B6C7D8E9F",
+		"Transaction ID: 0123456789abcdef0123\n":                                                     "0123456789abcdef0123",
+		"Chaincode invoke successful. result: status:200\n":                                          "",
+	} {
+		got := ""
+		if m := txIDPattern.FindStringSubmatch(output); m != nil {
+			got = m[1]
+		}
+		if got != want {
+			t.Errorf("%q: expected %q, got %q", output, want, got)
+		}
+	}
+}
+
+func TestPushReceipt(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("push.sh", scriptResult{Stdout: "Commit abc123 pushed to channel 'g1', transaction 9F86D081884C7D65\n"})
+
+	var answer scriptResponse
+	json.NewDecoder(env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"}).Body).Decode(&answer)
+	rc := answer.Receipt
+	if rc == nil || rc.Group != "g1" || rc.Commit != "abc123" || rc.Author != "alice" || rc.TxID != "9f86d081884c7d65" || rc.Time == "" {
+		t.Fatalf("expected a receipt for the push, got %+v", rc)
+	}
+
+	// anyone can check it with the published key
+	var key receiptKey
+	json.NewDecoder(env.get(t, "/receipts/key").Body).Decode(&key)
+	pub, _ := base64.StdEncoding.DecodeString(key.PublicKey)
+	sig, _ := base64.StdEncoding.DecodeString(rc.Signature)
+	if key.Algorithm != "Ed25519" || key.KeyID != rc.KeyID || !ed25519.Verify(pub, rc.payload(), sig) {
+		t.Fatalf("expected the receipt to verify with %+v", key)
+	}
+
+	// verify asks the server to check a receipt
+	verify := func(rc receipt) receiptCheck {
+		t.Helper()
+		var check receiptCheck
+		json.NewDecoder(env.post(t, "/receipts/verify", "", rc).Body).Decode(&check)
+		return check
+	}
+	if check := verify(*rc); !check.Valid {
+		t.Errorf("expected the receipt to be valid, got %+v", check)
+	}
+	late := *rc
+	late.Time = "2099-01-01T00:00:00Z"
+	if check := verify(late); check.Valid || check.Error == "" {
+		t.Errorf("expected a changed receipt to be invalid, got %+v", check)
+	}
+	other := *rc
+	other.KeyID = "0011223344556677"
+	if check := verify(other); check.Valid {
+		t.Errorf("expected another key to be invalid, got %+v", check)
+	}
+
+	// a field can't be shifted into the next one
+	shifted := receipt{Group: "g1", Commit: "c\nbob", Author: "alice", Time: "2021-03-01T10:00:00Z"}
+	if err := receipts.sign(&shifted); err != nil {
+		t.Fatal(err)
+	}
+	forged := shifted
+	forged.Commit, forged.Author, forged.TxID = "c", "bob", "alice\n"
+	if err := receipts.verify(forged); err == nil {
+		t.Error("expected a receipt with shifted fields to be invalid")
+	}
+	resp := env.post(t, "/receipts/verify", "", shifted)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a control character to be refused, got %d %s", resp.StatusCode, body)
+	}
+	resp = env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "c\nbob"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a commit with a newline to be refused, got %d %s", resp.StatusCode, body)
+	}
+
+	// failed pushes get no receipt
+	env.vm.script("push.sh", scriptResult{Stderr: "endorsement failure\n", Status: 1})
+	resp = env.post(t, "/push", "", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc124"})
+	if body := readBody(t, resp); resp.StatusCode == http.StatusOK {
+		t.Errorf("expected the push to fail, got %s", body)
+	}
+}
+
+// loadReceiptKey gives receipts a key generated in a file for the test
+func loadReceiptKey(t *testing.T) {
+	t.Helper()
+	oldReceipts := receipts
+	t.Cleanup(func() { receipts = oldReceipts })
+
+	c := defaultConfig()
+	c.ReceiptKeyFile = filepath.Join(t.TempDir(), "receipt.pem")
+	receipts = &receiptSigner{}
+	if err := receipts.load(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiptKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	keyFile := filepath.Join(dir, "receipt.pem")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	c := defaultConfig()
+	c.ReceiptKeyFile = keyFile
+	rs := &receiptSigner{}
+	if err := rs.load(c); err != nil {
+		t.Fatal(err)
+	}
+	rc := receipt{Group: "g1", Commit: "abc123", Author: "alice", Time: "2021-03-01T10:00:00Z"}
+	if err := rs.sign(&rc); err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(rc.Signature)
+	if rc.KeyID != keyID(pub) || !ed25519.Verify(pub, rc.payload(), sig) {
+		t.Errorf("expected the receipt to be signed with the key file, got %+v", rc)
+	}
+
+	// a missing key is generated once, then read back
+	c.ReceiptKeyFile = filepath.Join(dir, "data", "generated.pem")
+	first := &receiptSigner{}
+	if err := first.load(c); err != nil {
+		t.Fatal(err)
+	}
+	second := &receiptSigner{}
+	if err := second.load(c); err != nil {
+		t.Fatal(err)
+	}
+	rc = receipt{Group: "g1", Commit: "abc123", Author: "alice", Time: "2021-03-01T10:00:00Z"}
+	first.sign(&rc)
+	if err := second.verify(rc); err != nil {
+		t.Errorf("expected the receipt to verify after a restart, got %v", err)
+	}
+	if info, err := os.Stat(c.ReceiptKeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a private key file, got %v %v", info, err)
+	}
+
+	c.ReceiptKeyFile = ""
+	if err := rs.load(c); err == nil {
+		t.Error("expected a key file to be required")
+	}
+	if err := (&receiptSigner{}).sign(&rc); err != errNoReceiptKey {
+		t.Errorf("expected nothing to be signed before a key is loaded, got %v", err)
+	}
+	c.ReceiptKeyFile = keyFile
+	ioutil.WriteFile(keyFile, []byte("not a key"), 0600)
+	if err := rs.load(c); err == nil {
+		t.Error("expected a broken key file to be refused")
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// groupPrefix keys the sets of members of each group
+	groupPrefix = "group:"
+	// groupsKey is the set of the groups with members
+	groupsKey = "groups"
+)
+
+// the hashes pushed to every group are kept sorted, all with score 0 so a
+// prefix is a range by lex, and each hash keys the set of its occurrences
+// and of its groups. The sorted sets and the groups are also kept per kind
+// of occurrence, under kindKey.
+const (
+	hashesKey       = "hashes"
+	sharedHashesKey = "hashes:shared"
+	hashPrefix      = "hash:"
+)
+
+// kindKey returns the key of kind for key, key itself for every kind
+func kindKey(key, kind string) string {
+	if kind == "" {
+		return key
+	}
+	return key + ":" + kind
+}
+
+// redis deployments selectable in the config
+const (
+	redisStandalone = "standalone"
+	redisSentinel   = "sentinel"
+	redisCluster    = "cluster"
+)
+
+// redisTxRetries is how many times an optimistic transaction is tried
+// before giving up
+const redisTxRetries = 10
+
+const (
+	// redisMinBackoff and redisMaxBackoff bound the wait between two
+	// connection attempts at startup
+	redisMinBackoff = 500 * time.Millisecond
+	redisMaxBackoff = 10 * time.Second
+)
+
+// redisStore keeps the data in redis, shared by every replica
+type redisStore struct {
+	client redis.UniversalClient
+}
+
+// redisOptions builds the client options from the config
+func redisOptions() (*redis.UniversalOptions, error) {
+	op := &redis.UniversalOptions{
+		Addrs:        strings.Split(cfg.RedisHost, ","),
+		DB:           cfg.RedisDB,
+		MasterName:   cfg.RedisMasterName,
+		WriteTimeout: 5 * time.Second,
+		MaxRetries:   3,
+		PoolSize:     cfg.RedisPoolSize,
+		MinIdleConns: cfg.RedisMinIdleConns,
+		// authenticate on connect rather than through Password so a
+		// rotated password is picked up by new connections
+		OnConnect: redisAuth,
+	}
+	for i, addr := range op.Addrs {
+		op.Addrs[i] = strings.TrimSpace(addr)
+	}
+	useTLS := cfg.RedisTLS
+
+	if cfg.RedisURL != "" {
+		u, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		op.Addrs, op.DB, op.Username = []string{u.Addr}, u.DB, u.Username
+		if u.Password != "" {
+			op.Password, op.OnConnect = u.Password, nil
+		}
+		useTLS = u.TLSConfig != nil
+	}
+
+	if useTLS {
+		op.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.RedisCAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.RedisCAFile)
+			if err != nil {
+				return nil, err
+			}
+			op.TLSConfig.RootCAs = x509.NewCertPool()
+			if !op.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("%s: no certificate found", cfg.RedisCAFile)
+			}
+		}
+	}
+	return op, nil
+}
+
+// newRedisClient connects to the redis of the config, in the mode it is
+// deployed in
+func newRedisClient() (redis.UniversalClient, error) {
+	op, err := redisOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var client redis.UniversalClient
+	switch cfg.RedisMode {
+	case redisSentinel:
+		client = redis.NewFailoverClient(op.Failover())
+	case redisCluster:
+		client = redis.NewClusterClient(op.Cluster())
+	default:
+		client = redis.NewClient(op.Simple())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.RedisConnectTimeout)
+	defer cancel()
+	if err := waitForRedis(ctx, client); err != nil {
+		// keep serving so /readyz can report the failure instead of the
+		// container restarting in a loop
+		logger.Error("failed to connect to redis", "mode", cfg.RedisMode, "addrs", op.Addrs, "error", err)
+	} else {
+		logger.Info("connected to redis", "mode", cfg.RedisMode, "addrs", op.Addrs)
+	}
+	return client, nil
+}
+
+// waitForRedis pings client until it answers, backing off between the
+// attempts, and returns the last error once ctx is done. It always tries
+// at least once.
+func waitForRedis(ctx context.Context, client redis.UniversalClient) error {
+	backoff := redisMinBackoff
+	for {
+		pingCtx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		err := client.Ping(pingCtx).Err()
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		logger.Warn("redis not reachable, retrying", "error", err, "backoff", backoff.String())
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// redisAuth authenticates a new redis connection with the current password
+func redisAuth(ctx context.Context, cn *redis.Conn) error {
+	password := cfg.RedisPassword.Get()
+	if password == "" {
+		return nil
+	}
+	return cn.Auth(ctx, password).Err()
+}
+
+func newRedisStore(client redis.UniversalClient) *redisStore {
+	return &redisStore{client: client}
+}
+
+func (rs *redisStore) saveUser(ctx context.Context, id string, fields map[string]interface{}) error {
+	return rs.client.HSet(ctx, keyPrefix+id, fields).Err()
+}
+
+func (rs *redisStore) user(ctx context.Context, id string) (map[string]string, error) {
+	return rs.client.HGetAll(ctx, keyPrefix+id).Result()
+}
+
+func (rs *redisStore) setPublicKey(ctx context.Context, author string, key []byte, replace bool) (bool, error) {
+	if replace {
+		return true, rs.client.Set(ctx, keyPrefix+author+":pubkey", key, 0).Err()
+	}
+	return rs.client.SetNX(ctx, keyPrefix+author+":pubkey", key, 0).Result()
+}
+
+func (rs *redisStore) publicKey(ctx context.Context, author string) ([]byte, error) {
+	key, err := rs.client.Get(ctx, keyPrefix+author+":pubkey").Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return key, err
+}
+
+// enrolmentKey names the enrolment token of author by its hash, the token
+// itself is a secret
+func enrolmentKey(author, token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return keyPrefix + author + ":enrolment:" + hex.EncodeToString(sum[:])
+}
+
+func (rs *redisStore) addEnrolment(ctx context.Context, author, token string, ttl time.Duration) error {
+	return rs.client.Set(ctx, enrolmentKey(author, token), 1, ttl).Err()
+}
+
+func (rs *redisStore) useEnrolment(ctx context.Context, author, token string) (bool, error) {
+	n, err := rs.client.Del(ctx, enrolmentKey(author, token)).Result()
+	return n == 1, err
+}
+
+func (rs *redisStore) useNonce(ctx context.Context, author, nonce string, ttl time.Duration) (bool, error) {
+	return rs.client.SetNX(ctx, keyPrefix+author+":nonce:"+nonce, 1, ttl).Result()
+}
+
+func (rs *redisStore) forgetNonce(ctx context.Context, author, nonce string) error {
+	return rs.client.Del(ctx, keyPrefix+author+":nonce:"+nonce).Err()
+}
+
+func (rs *redisStore) addMember(ctx context.Context, group, author string) error {
+	// not a transaction, the keys may live on different cluster nodes
+	if err := rs.client.SAdd(ctx, groupPrefix+group+":members", author).Err(); err != nil {
+		return err
+	}
+	return rs.client.SAdd(ctx, groupsKey, group).Err()
+}
+
+func (rs *redisStore) members(ctx context.Context, group string) ([]string, error) {
+	members, err := rs.client.SMembers(ctx, groupPrefix+group+":members").Result()
+	sort.Strings(members)
+	return members, err
+}
+
+func (rs *redisStore) groups(ctx context.Context) ([]string, error) {
+	groups, err := rs.client.SMembers(ctx, groupsKey).Result()
+	sort.Strings(groups)
+	return groups, err
+}
+
+func (rs *redisStore) saveCommit(ctx context.Context, group, commit string, meta commitMetadata) error {
+	payload, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return rs.client.HSet(ctx, groupPrefix+group+":commits", commit, payload).Err()
+}
+
+func (rs *redisStore) commits(ctx context.Context, group string, hashes []string) (map[string]commitMetadata, error) {
+	metas := map[string]commitMetadata{}
+	if len(hashes) == 0 {
+		return metas, nil
+	}
+	payloads, err := rs.client.HMGet(ctx, groupPrefix+group+":commits", hashes...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range payloads {
+		s, ok := p.(string)
+		if !ok {
+			continue
+		}
+		var meta commitMetadata
+		if err := json.Unmarshal([]byte(s), &meta); err != nil {
+			return nil, err
+		}
+		metas[hashes[i]] = meta
+	}
+	return metas, nil
+}
+
+func (rs *redisStore) indexCommits(ctx context.Context, group string, entries []historyEntry, complete bool) error {
+	key := groupPrefix + group + ":index"
+	// not a transaction, the keys may live on different cluster nodes
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		if complete {
+			pipe.Del(ctx, key)
+		}
+		for c, e := range firstPushes(entries) {
+			payload, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			pipe.HSetNX(ctx, key, c, payload)
+		}
+		if complete {
+			pipe.Set(ctx, groupPrefix+group+":indexed", time.Now().UTC().Format(time.RFC3339Nano), 0)
+		}
+		return nil
+	})
+	return err
+}
+
+func (rs *redisStore) indexedCommit(ctx context.Context, group, hash string) (historyEntry, bool, time.Time, error) {
+	var refreshed time.Time
+	stamp, err := rs.client.Get(ctx, groupPrefix+group+":indexed").Result()
+	switch {
+	case err == nil:
+		refreshed, _ = time.Parse(time.RFC3339Nano, stamp)
+	case err != redis.Nil:
+		return historyEntry{}, false, refreshed, err
+	}
+	stamp, err = rs.client.Get(ctx, groupPrefix+group+":refreshfailed").Result()
+	switch {
+	case err == nil:
+		if failed, perr := time.Parse(time.RFC3339Nano, stamp); perr == nil && failed.After(refreshed) {
+			refreshed = failed
+		}
+	case err != redis.Nil:
+		return historyEntry{}, false, refreshed, err
+	}
+
+	var e historyEntry
+	payload, err := rs.client.HGet(ctx, groupPrefix+group+":index", hash).Bytes()
+	if err == redis.Nil {
+		return e, false, refreshed, nil
+	}
+	if err != nil {
+		return e, false, refreshed, err
+	}
+	err = json.Unmarshal(payload, &e)
+	return e, err == nil, refreshed, err
+}
+
+func (rs *redisStore) failRefresh(ctx context.Context, group string, ttl time.Duration) error {
+	return rs.client.Set(ctx, groupPrefix+group+":refreshfailed", time.Now().UTC().Format(time.RFC3339Nano), ttl).Err()
+}
+
+func (rs *redisStore) indexHashes(ctx context.Context, occs map[string][]hashOccurrence) error {
+	if len(occs) == 0 {
+		return nil
+	}
+	// the group counts by hash then kind, "" for every kind
+	groupCounts := map[string]map[string]*redis.IntCmd{}
+	// not a transaction, the keys may live on different cluster nodes
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for h, list := range occs {
+			groupCounts[h] = map[string]*redis.IntCmd{}
+			pipe.ZAdd(ctx, hashesKey, &redis.Z{Member: h})
+			for _, o := range list {
+				payload, err := json.Marshal(o)
+				if err != nil {
+					return err
+				}
+				pipe.SAdd(ctx, hashPrefix+h, payload)
+				pipe.SAdd(ctx, hashPrefix+h+":groups", o.Group)
+				pipe.ZAdd(ctx, kindKey(hashesKey, o.Kind), &redis.Z{Member: h})
+				pipe.SAdd(ctx, kindKey(hashPrefix+h+":groups", o.Kind), o.Group)
+				groupCounts[h][o.Kind] = nil
+			}
+			for kind := range groupCounts[h] {
+				groupCounts[h][kind] = pipe.SCard(ctx, kindKey(hashPrefix+h+":groups", kind))
+			}
+			groupCounts[h][""] = pipe.SCard(ctx, hashPrefix+h+":groups")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	shared := map[string][]*redis.Z{}
+	for h, counts := range groupCounts {
+		for kind, n := range counts {
+			if n.Val() > 1 {
+				shared[kind] = append(shared[kind], &redis.Z{Member: h})
+			}
+		}
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+	_, err = rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for kind, members := range shared {
+			pipe.ZAdd(ctx, kindKey(sharedHashesKey, kind), members...)
+		}
+		return nil
+	})
+	return err
+}
+
+// hashMatches loads the occurrences of kind, any when empty, of hashes
+func (rs *redisStore) hashMatches(ctx context.Context, hashes []string, kind string) ([]hashMatch, error) {
+	members := make([]*redis.StringSliceCmd, len(hashes))
+	_, err := rs.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, h := range hashes {
+			members[i] = pipe.SMembers(ctx, hashPrefix+h)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]hashMatch, 0, len(hashes))
+	for i, h := range hashes {
+		m := hashMatch{Hash: h}
+		for _, payload := range members[i].Val() {
+			var o hashOccurrence
+			if err := json.Unmarshal([]byte(payload), &o); err != nil {
+				return nil, err
+			}
+			if kind == "" || o.Kind == kind {
+				m.Occurrences = append(m.Occurrences, o)
+			}
+		}
+		sortOccurrences(m.Occurrences)
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+func (rs *redisStore) searchHashes(ctx context.Context, prefix, kind string, limit int) ([]hashMatch, error) {
+	// the hashes are hex, every one starting with prefix sorts before
+	// prefix followed by a byte above "f"
+	hashes, err := rs.client.ZRangeByLex(ctx, kindKey(hashesKey, kind), &redis.ZRangeBy{
+		Min: "[" + prefix, Max: "(" + prefix + "g", Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return rs.hashMatches(ctx, hashes, kind)
+}
+
+func (rs *redisStore) sharedHashes(ctx context.Context, kind string, limit int) ([]hashMatch, error) {
+	hashes, err := rs.client.ZRange(ctx, kindKey(sharedHashesKey, kind), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return rs.hashMatches(ctx, hashes, kind)
+}
+
+// readLineage decodes the graph kept in the hash key
+func readLineage(ctx context.Context, c redis.Cmdable, key string) (map[string]commitNode, error) {
+	payloads, err := c.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]commitNode, len(payloads))
+	for commit, p := range payloads {
+		var n commitNode
+		if err := json.Unmarshal([]byte(p), &n); err != nil {
+			return nil, err
+		}
+		nodes[commit] = n
+	}
+	return nodes, nil
+}
+
+func (rs *redisStore) lineage(ctx context.Context, group string) (map[string]commitNode, error) {
+	return readLineage(ctx, rs.client, groupPrefix+group+":lineage")
+}
+
+func (rs *redisStore) addCommitNode(ctx context.Context, group string, node commitNode, strict bool) ([]string, error) {
+	// the whole graph is one hash, watched so that two replicas pushing at
+	// once are checked against each other
+	key := groupPrefix + group + ":lineage"
+	add := func(tx *redis.Tx) error {
+		nodes, err := readLineage(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		node.Flags = lineageFlags(nodes, node)
+		if strict && node.Flags != nil {
+			return nil
+		}
+		if _, dup := nodes[node.Commit]; dup {
+			return nil
+		}
+		payload, err := json.Marshal(node)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return pipe.HSet(ctx, key, node.Commit, payload).Err()
+		})
+		return err
+	}
+
+	for i := 0; i < redisTxRetries; i++ {
+		err := rs.client.Watch(ctx, add, key)
+		if err != redis.TxFailedErr {
+			return node.Flags, err
+		}
+	}
+	return nil, fmt.Errorf("lineage of %s changed %d times while adding %s", group, redisTxRetries, node.Commit)
+}
+
+func (rs *redisStore) removeCommitNode(ctx context.Context, group, commit string) error {
+	return rs.client.HDel(ctx, groupPrefix+group+":lineage", commit).Err()
+}
+
+func (rs *redisStore) saveJob(ctx context.Context, info jobInfo) error {
+	return rs.client.HSet(ctx, jobPrefix+info.ID,
+		"Script", info.Script,
+		"RequestID", info.RequestID,
+		"Role", info.Role,
+		"State", info.State,
+		"Started", info.Started.Format(time.RFC3339),
+	).Err()
+}
+
+func (rs *redisStore) job(ctx context.Context, id string) (jobInfo, bool, error) {
+	fields, err := rs.client.HGetAll(ctx, jobPrefix+id).Result()
+	if err != nil || len(fields) == 0 {
+		return jobInfo{}, false, err
+	}
+	started, _ := time.Parse(time.RFC3339, fields["Started"])
+	return jobInfo{
+		ID:        id,
+		Script:    fields["Script"],
+		RequestID: fields["RequestID"],
+		Role:      fields["Role"],
+		State:     fields["State"],
+		Started:   started,
+	}, true, nil
+}
+
+func (rs *redisStore) audit(ctx context.Context, e auditEntry) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	pipe := rs.client.TxPipeline()
+	pipe.LPush(ctx, auditKey, payload)
+	pipe.LTrim(ctx, auditKey, 0, maxAuditEntries-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (rs *redisStore) auditLog(ctx context.Context, n int) ([]auditEntry, error) {
+	payloads, err := rs.client.LRange(ctx, auditKey, 0, int64(n)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]auditEntry, 0, len(payloads))
+	for _, p := range payloads {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(p), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (rs *redisStore) publish(ctx context.Context, channel string, payload []byte) error {
+	return rs.client.Publish(ctx, channel, payload).Err()
+}
+
+func (rs *redisStore) subscribe(ctx context.Context, channels ...string) (*subscription, error) {
+	sub := rs.client.Subscribe(ctx, channels...)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	c := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		defer close(c)
+		for msg := range sub.Channel() {
+			select {
+			case c <- []byte(msg.Payload):
+			case <-done:
+				return
+			}
+		}
+	}()
+	return &subscription{C: c, close: func() error {
+		close(done)
+		return sub.Close()
+	}}, nil
+}
+
+func (rs *redisStore) clear(ctx context.Context) error {
+	// a cluster only flushes the node the command lands on
+	if cluster, ok := rs.client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+			return master.FlushAll(ctx).Err()
+		})
+	}
+	return rs.client.FlushAll(ctx).Err()
+}
+
+// ready checks redis answers
+func (rs *redisStore) ready(ctx context.Context, checks map[string]checkResult) {
+	checks["redis"] = timed(func() error {
+		ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+		defer cancel()
+		return rs.client.Ping(ctx).Err()
+	})
+}
+
+func (rs *redisStore) Close() error {
+	return rs.client.Close()
+}
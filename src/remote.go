@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultScriptTimeouts caps how long each bloc-server script may run.
+// They can be changed per script in the config.
+// Bringing the Fabric network up is by far the slowest.
+var defaultScriptTimeouts = map[string]time.Duration{
+	"init.sh":          15 * time.Minute,
+	"clear.sh":         5 * time.Minute,
+	"createchannel.sh": 5 * time.Minute,
+	"push.sh":          2 * time.Minute,
+	"gethistory.sh":    time.Minute,
+	"test.sh":          time.Minute,
+}
+
+// fallbackScriptTimeout applies to scripts with no timeout of their own
+const fallbackScriptTimeout = 5 * time.Minute
+
+// scriptTimeout returns how long script may run, see config
+func scriptTimeout(script string) time.Duration {
+	if cfg.ScriptTimeout > 0 {
+		return cfg.ScriptTimeout
+	}
+	if d, ok := cfg.ScriptTimeouts[script]; ok {
+		return d
+	}
+	return fallbackScriptTimeout
+}
+
+// scriptError is a failure to run a script with the status to report
+type scriptError struct {
+	status int
+	msg    string
+}
+
+func (e *scriptError) Error() string {
+	return e.msg
+}
+
+// errNetworkBusy is returned by runScript when another script holds the lock
+// of the operation
+var errNetworkBusy = &scriptError{http.StatusInternalServerError, "Blockchain network being used, try again next time"}
+
+// writeScriptError reports err, as returned by runScript, to the client
+func writeScriptError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if se, ok := err.(*scriptError); ok {
+		status = se.status
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// backends selectable in the config
+const (
+	backendSSH       = "ssh"
+	backendSimulator = "simulator"
+)
+
+// backend is where the bloc-server scripts run: the VM over ssh, or the
+// simulator when developing without one
+type backend interface {
+	// connect opens the connection the script of one request runs over
+	connect() (scriptConn, error)
+	// ready adds the checks of the backend to a readiness report
+	ready(ctx context.Context, checks map[string]checkResult)
+}
+
+// scriptConn runs a script, see runSession
+type scriptConn interface {
+	run(ctx context.Context, op *operation, args []string, j *job) ([]byte, error)
+	Close() error
+}
+
+// vm is the backend the server runs its scripts on, set from the config
+var vm backend = sshBackend{}
+
+// newBackend returns the backend selected in the config
+func newBackend() (backend, error) {
+	if cfg.Backend == backendSimulator {
+		return newSimulator(cfg.SimulatorFile)
+	}
+	return sshBackend{}, nil
+}
+
+// sshBackend runs the scripts on the VM
+type sshBackend struct{}
+
+func (sshBackend) connect() (scriptConn, error) {
+	conn, err := dialVM()
+	if err != nil {
+		return nil, err
+	}
+	return sshConn{conn}, nil
+}
+
+// sshConn is an ssh connection to the VM
+type sshConn struct {
+	*ssh.Client
+}
+
+func (c sshConn) run(ctx context.Context, op *operation, args []string, j *job) ([]byte, error) {
+	return runSession(ctx, c.Client, op.command(args, requestID(ctx)), j)
+}
+
+// dialVM opens an ssh connection to the VM
+func dialVM() (*ssh.Client, error) {
+	return ssh.Dial("tcp", cfg.vmAddr(), sshClientConfig())
+}
+
+// runScript runs op with args on the backend, holding the lock of the operation
+// scope for group, and returns the script stdout. The script is stopped when
+// ctx is cancelled (client gone, shutdown) or its timeout expires, so a hung
+// script can't keep the lock forever. The job id is set on w.
+func runScript(ctx context.Context, w http.ResponseWriter, op *operation, args []string, group string) ([]byte, error) {
+	if atomic.LoadUint32(&draining) == 1 {
+		return nil, &scriptError{http.StatusServiceUnavailable, "Server shutting down, try again later"}
+	}
+
+	release, ok := locks.tryLock(op.Lock, group)
+	if !ok {
+		loggerFrom(ctx).Warn("locked out, another script is running", "operation", op.Name)
+		return nil, errNetworkBusy
+	}
+	defer release()
+
+	conn, err := vm.connect()
+	if err != nil {
+		return nil, &scriptError{http.StatusBadGateway, "Can't reach the blockchain VM: " + err.Error()}
+	}
+	defer conn.Close()
+
+	j, ctx := jobs.start(ctx, op.scriptName(), op.Role)
+	l := loggerFrom(ctx).With("job_id", j.ID, "script", j.Script)
+	l.Info("running script", "operation", op.Name)
+
+	ctx, cancel := context.WithTimeout(ctx, op.timeout())
+	defer cancel()
+
+	w.Header().Set("X-Job-ID", j.ID)
+	jobStarted(ctx, j)
+	results, err := conn.run(ctx, op, args, j)
+	// finishing the job cancels ctx, see why the script stopped first
+	ctxErr := ctx.Err()
+	jobs.finish(j, err)
+	if err != nil {
+		l.Error("script failed", "error", err)
+		switch {
+		case ctxErr == context.DeadlineExceeded:
+			return nil, &scriptError{http.StatusGatewayTimeout, "Remote command timed out"}
+		case ctxErr != nil:
+			// the client went away or the server is shutting down, nobody
+			// is left to read an answer
+			return nil, &scriptError{http.StatusServiceUnavailable, "Remote command cancelled"}
+		default:
+			return nil, &scriptError{http.StatusInternalServerError, "Can't run remote command: " + err.Error()}
+		}
+	}
+	return results, nil
+}
+
+// runSession runs cmd in a new session and returns its stdout, every line
+// is also handed to j as it arrives so it can be followed live. If ctx is
+// done first the remote process is sent SIGTERM and the session closed.
+func runSession(ctx context.Context, conn *ssh.Client, cmd string, j *job) ([]byte, error) {
+	sess, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	var stdout, stderr bytes.Buffer
+	outLines, errLines := j.output("stdout"), j.output("stderr")
+	sess.Stdout = io.MultiWriter(&stdout, outLines)
+	sess.Stderr = io.MultiWriter(&stderr, errLines)
+	if err := sess.Start(cmd); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		outLines.flush()
+		errLines.flush()
+		if err != nil && stderr.Len() > 0 {
+			loggerFrom(ctx).Warn("remote stderr", "job_id", j.ID, "stderr", strings.TrimSpace(stderr.String()))
+		}
+		return stdout.Bytes(), err
+	case <-ctx.Done():
+		// sudo relays the signal to the script
+		sess.Signal(ssh.SIGTERM)
+		sess.Close()
+		return nil, ctx.Err()
+	}
+}
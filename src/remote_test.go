@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScriptTimeout(t *testing.T) {
+	oldCfg := cfg
+	cfg = defaultConfig()
+	defer func() { cfg = oldCfg }()
+
+	if got := scriptTimeout("init.sh"); got != 15*time.Minute {
+		t.Errorf("expected init.sh default, got %s", got)
+	}
+	if got := scriptTimeout("unknown.sh"); got != fallbackScriptTimeout {
+		t.Errorf("expected fallback timeout, got %s", got)
+	}
+
+	cfg.ScriptTimeouts["push.sh"] = 30 * time.Second
+	if got := scriptTimeout("push.sh"); got != 30*time.Second {
+		t.Errorf("expected per script setting, got %s", got)
+	}
+
+	cfg.ScriptTimeout = time.Minute
+	if got := scriptTimeout("push.sh"); got != time.Minute {
+		t.Errorf("expected global override, got %s", got)
+	}
+}
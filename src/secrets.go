@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// secret is a credential given directly or read from a file, as mounted by
+// Docker or Kubernetes secrets. A file backed secret can be reloaded while
+// the server runs.
+type secret struct {
+	mu    sync.RWMutex
+	value string
+	file  string
+}
+
+// Get returns the current value
+func (s *secret) Get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// String makes secret a flag.Value
+func (s *secret) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.Get()
+}
+
+// Set makes secret a flag.Value
+func (s *secret) Set(v string) error {
+	s.mu.Lock()
+	s.value = v
+	s.mu.Unlock()
+	return nil
+}
+
+// load reads the secret file, if any. The trailing newline most tools add
+// is not part of the secret.
+func (s *secret) load() error {
+	if s.file == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	return s.Set(strings.TrimRight(string(b), "\r\n"))
+}
+
+// reloadSecrets reads the secret files again, used on SIGHUP
+func reloadSecrets() {
+	for name, s := range map[string]*secret{"vm password": cfg.VMPassword, "redis password": cfg.RedisPassword} {
+		if s.file == "" {
+			continue
+		}
+		if err := s.load(); err != nil {
+			logger.Error("failed to reload secret", "secret", name, "file", s.file, "error", err)
+			continue
+		}
+		logger.Info("reloaded secret", "secret", name, "file", s.file)
+	}
+}
+
+// minRedactLen keeps very short secrets from blanking out common words
+const minRedactLen = 4
+
+// credentialPatterns catch credentials that are not one of our own secrets,
+// like the password of a user in a request body
+var credentialPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)("?(?:password|passwd|secret|token|apikey|api_key)"?\s*[:=]\s*"?)([^"\s,;&}]+)`),
+	regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic)\s+)(\S+)`),
+}
+
+// redactingWriter scrubs credentials from everything written to the log
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := rw.w.Write([]byte(redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redact replaces the configured secrets and anything that looks like a
+// credential in s
+func redact(s string) string {
+	for _, sec := range []*secret{cfg.VMPassword, cfg.RedisPassword} {
+		if v := sec.Get(); len(v) >= minRedactLen {
+			s = strings.Replace(s, v, redacted, -1)
+			// as the json logger escapes it, quotes, backslashes and <>&
+			quoted, _ := json.Marshal(v)
+			s = strings.Replace(s, string(quoted[1:len(quoted)-1]), redacted, -1)
+		}
+	}
+	for _, re := range credentialPatterns {
+		s = re.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// draining is set once a shutdown started, no new script is accepted after
+var draining uint32
+
+// serve runs srv until SIGTERM or SIGINT, then drains the running scripts
+// before closing the store. SIGHUP reloads the secret files, the custom
+// operations and the TLS certificate.
+func serve(srv *http.Server, st store) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			reloadSecrets()
+			customOps.reloadAndLog(true)
+			serverTLS.reloadAndLog(true)
+		}
+	}()
+
+	go customOps.watch(ctx)
+	go serverTLS.watch(ctx)
+
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// the certificate comes from TLSConfig.GetCertificate
+			errc <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down, waiting for running scripts")
+	atomic.StoreUint32(&draining, 1)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// stop accepting connections and wait for the handlers, which block
+	// on their scripts, to return
+	err := srv.Shutdown(drainCtx)
+	if err == nil {
+		err = jobs.wait(drainCtx)
+	}
+	if err != nil {
+		logger.Warn("scripts still running after drain timeout", "error", err)
+		if err := jobs.interrupt(context.Background(), st); err != nil {
+			logger.Error("failed to persist interrupted jobs", "error", err)
+		}
+		srv.Close()
+	}
+
+	return st.Close()
+}
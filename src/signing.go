@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ed25519"
+)
+
+// push signature policies selectable in the config
+const (
+	// signaturesOff ignores the signatures
+	signaturesOff = "off"
+	// signaturesRegistered requires a signature from the authors who
+	// registered a key, and verifies the ones the others send
+	signaturesRegistered = "registered"
+	// signaturesRequire refuses every unsigned push
+	signaturesRequire = "require"
+)
+
+// pushSigningDomain starts every signed payload so a push signature can't
+// be mistaken for any other the key makes
+const pushSigningDomain = "gatherchain-push/v1"
+
+// enrolmentTTL is how long a student has to register their first key
+// with the enrolment token an admin issued
+const enrolmentTTL = 7 * 24 * time.Hour
+
+// noncePattern is what a client may use as the nonce of a signature
+var noncePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,128}$`)
+
+// pushSignature is the proof that the Author of a push authorized it
+type pushSignature struct {
+	// Key is the public key the signature was verified with, base64
+	Key       string
+	Signature string
+	SignedAt  string
+	Nonce     string
+}
+
+// pushSigningPayload returns the bytes the author signs for a push: the
+// domain, the group, the commit, the RFC 3339 signing time and the nonce,
+// each on its own line
+func pushSigningPayload(group, commit, signedAt, nonce string) []byte {
+	return []byte(strings.Join([]string{pushSigningDomain, group, commit, signedAt, nonce}, "\n"))
+}
+
+// checkSignature reads the signature fields of a push body into cp, they
+// are verified before the script runs
+func checkSignature(body []byte, cp *ContentPost) error {
+	var sig pushSignature
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &sig); err != nil {
+			return err
+		}
+	}
+	if sig.Signature == "" && sig.SignedAt == "" && sig.Nonce == "" {
+		return nil
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(sig.Signature); err != nil || sig.Signature == "" {
+		return fmt.Errorf("Signature must be base64")
+	}
+	if _, err := time.Parse(time.RFC3339, sig.SignedAt); err != nil {
+		return fmt.Errorf("SignedAt must be RFC 3339: %v", err)
+	}
+	if !noncePattern.MatchString(sig.Nonce) {
+		return fmt.Errorf("Nonce must be 8 to 128 letters, digits, - or _")
+	}
+	// a newline would let two different pushes share a payload
+	if strings.Contains(cp.Group+cp.Commit, "\n") {
+		return fmt.Errorf("a signed push can't have a newline in its Group or Commit")
+	}
+	// set once verified, not by the client
+	sig.Key = ""
+	cp.Signature = &sig
+	return nil
+}
+
+// forbidden is a push refused for its signature
+func forbidden(format string, a ...interface{}) error {
+	return &scriptError{status: http.StatusForbidden, msg: fmt.Sprintf(format, a...)}
+}
+
+// verifyPush checks the signature of a push against the key its Author
+// registered, and that it is fresh and not replayed
+func (uh userHandler) verifyPush(ctx context.Context, cp ContentPost) error {
+	if cfg.PushSignatures == signaturesOff {
+		return nil
+	}
+	key, err := uh.store.publicKey(ctx, cp.Author)
+	if err != nil {
+		return err
+	}
+
+	sig := cp.Signature
+	if sig == nil {
+		switch {
+		case cfg.PushSignatures == signaturesRequire:
+			return forbidden("pushes must be signed")
+		case key != nil:
+			return forbidden("%s registered a key, their pushes must be signed", cp.Author)
+		}
+		return nil
+	}
+	if key == nil {
+		return forbidden("%s has no registered key", cp.Author)
+	}
+
+	signedAt, _ := time.Parse(time.RFC3339, sig.SignedAt)
+	if age := time.Since(signedAt); age > cfg.SignatureMaxAge || age < -cfg.SignatureMaxAge {
+		return forbidden("signature made at %s, more than %s from now", sig.SignedAt, cfg.SignatureMaxAge)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(sig.Signature)
+	if !ed25519.Verify(key, pushSigningPayload(cp.Group, cp.Commit, sig.SignedAt, sig.Nonce), raw) {
+		return forbidden("signature doesn't match the key of %s", cp.Author)
+	}
+
+	// the nonce only needs remembering while the signature is fresh
+	fresh, err := uh.store.useNonce(ctx, cp.Author, sig.Nonce, 2*cfg.SignatureMaxAge)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return forbidden("nonce %s already used", sig.Nonce)
+	}
+	sig.Key = base64.StdEncoding.EncodeToString(key)
+	return nil
+}
+
+// releaseNonce forgets the nonce of a verified push that never reached
+// the network, so the same signed push can be retried
+func (uh userHandler) releaseNonce(ctx context.Context, cp ContentPost) {
+	// the key is only set once verified, an unverified nonce stays used
+	if cp.Signature == nil || cp.Signature.Key == "" {
+		return
+	}
+	if err := uh.store.forgetNonce(ctx, cp.Author, cp.Signature.Nonce); err != nil {
+		loggerFrom(ctx).Warn("failed to release nonce", "author", cp.Author, "error", err)
+	}
+}
+
+// keyRequest is the body of PUT /users/{Author}/key
+type keyRequest struct {
+	// PublicKey is the Ed25519 public key of the author, base64
+	PublicKey string
+	// Enrolment is the token an admin issued the author for their first
+	// key
+	Enrolment string `json:",omitempty"`
+}
+
+// enrolment is the answer of POST /users/{Author}/enrolment
+type enrolment struct {
+	Author  string
+	Token   string
+	Expires time.Time
+}
+
+// issueEnrolment gives an admin a one-time token to hand to an author, who
+// proves with it that the first key they register is theirs
+func (uh userHandler) issueEnrolment(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Wrong Password", http.StatusForbidden)
+		return
+	}
+	author := mux.Vars(r)["Author"]
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e := enrolment{Author: author, Token: hex.EncodeToString(raw), Expires: time.Now().UTC().Add(enrolmentTTL)}
+	if err := uh.store.addEnrolment(r.Context(), author, e.Token, enrolmentTTL); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("issued enrolment token", "author", author)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
+
+// putKey registers the public key of an author. The first key takes the
+// enrolment token an admin issued the author, replacing it takes the admin
+// password.
+func (uh userHandler) putKey(w http.ResponseWriter, r *http.Request) {
+	author := mux.Vars(r)["Author"]
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var kr keyRequest
+	if err := json.Unmarshal(reqBody, &kr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(kr.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		http.Error(w, fmt.Sprintf("PublicKey must be a base64 Ed25519 key of %d bytes", ed25519.PublicKeySize), http.StatusBadRequest)
+		return
+	}
+
+	replace := isAdminRequest(r)
+	if !replace {
+		enrolled, err := uh.store.useEnrolment(r.Context(), author, kr.Enrolment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !enrolled {
+			http.Error(w, "Enrolment must be a token an admin issued to "+author, http.StatusForbidden)
+			return
+		}
+	}
+	recorded, err := uh.store.setPublicKey(r.Context(), author, key, replace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !recorded {
+		http.Error(w, author+" already registered a key, ask an admin to replace it", http.StatusConflict)
+		return
+	}
+
+	loggerFrom(r.Context()).Info("registered public key", "author", author, "replaced", replace)
+	if replace {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// getKey returns the public key of an author
+func (uh userHandler) getKey(w http.ResponseWriter, r *http.Request) {
+	author := mux.Vars(r)["Author"]
+	key, err := uh.store.publicKey(r.Context(), author)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyRequest{PublicKey: base64.StdEncoding.EncodeToString(key)})
+}
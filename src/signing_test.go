@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// enrol returns an enrolment token for author, issued by the admin
+func (env *testEnv) enrol(t *testing.T, author string) string {
+	t.Helper()
+	req, _ := http.NewRequest("POST", env.srv.URL+"/users/"+author+"/enrolment", nil)
+	req.Header.Set(adminPasswordHeader, env.vm.Password)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var e enrolment
+	json.NewDecoder(resp.Body).Decode(&e)
+	if resp.StatusCode != http.StatusCreated || e.Token == "" || e.Author != author {
+		t.Fatalf("expected an enrolment token, got %d %+v", resp.StatusCode, e)
+	}
+	return e.Token
+}
+
+// putKey registers key for author with the enrolment token, or as the
+// admin when admin is set
+func (env *testEnv) putKey(t *testing.T, author string, key ed25519.PublicKey, token string, admin bool) int {
+	t.Helper()
+	body, _ := json.Marshal(keyRequest{PublicKey: base64.StdEncoding.EncodeToString(key), Enrolment: token})
+	req, _ := http.NewRequest("PUT", env.srv.URL+"/users/"+author+"/key", bytes.NewReader(body))
+	if admin {
+		req.Header.Set(adminPasswordHeader, env.vm.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// signedPush returns the body of a push of commit to g1 signed with priv
+// at signedAt
+func signedPush(priv ed25519.PrivateKey, author, commit, nonce string, signedAt time.Time) map[string]interface{} {
+	at := signedAt.UTC().Format(time.RFC3339)
+	sig := ed25519.Sign(priv, pushSigningPayload("g1", commit, at, nonce))
+	return map[string]interface{}{
+		"Author": author, "Group": "g1", "Commit": commit,
+		"Signature": base64.StdEncoding.EncodeToString(sig),
+		"SignedAt":  at,
+		"Nonce":     nonce,
+	}
+}
+
+func TestRegisterKey(t *testing.T) {
+	env := newTestEnv(t)
+	key1, _, _ := ed25519.GenerateKey(nil)
+	key2, _, _ := ed25519.GenerateKey(nil)
+
+	// nobody registers a key in someone else's name
+	if status := env.putKey(t, "alice", key1, "", false); status != http.StatusForbidden {
+		t.Fatalf("expected a key without enrolment to be refused, got %d", status)
+	}
+	bobs := env.enrol(t, "bob")
+	if status := env.putKey(t, "alice", key1, bobs, false); status != http.StatusForbidden {
+		t.Fatalf("expected the token of bob to be refused for alice, got %d", status)
+	}
+	if status := env.putKey(t, "alice", key1, "0011", false); status != http.StatusForbidden {
+		t.Fatalf("expected a made up token to be refused, got %d", status)
+	}
+	if req, _ := http.NewRequest("POST", env.srv.URL+"/users/alice/enrolment", nil); true {
+		resp, _ := http.DefaultClient.Do(req)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("expected enrolment to need the admin password, got %d", resp.StatusCode)
+		}
+	}
+
+	token := env.enrol(t, "alice")
+	if status := env.putKey(t, "alice", key1, token, false); status != http.StatusCreated {
+		t.Fatalf("expected the first key to be registered, got %d", status)
+	}
+	if status := env.putKey(t, "alice", key2, env.enrol(t, "alice"), false); status != http.StatusConflict {
+		t.Errorf("expected a student not to replace the key, got %d", status)
+	}
+	if status := env.putKey(t, "alice", key2, token, false); status != http.StatusForbidden {
+		t.Errorf("expected a spent token to be refused, got %d", status)
+	}
+	if status := env.putKey(t, "bob", key1[:16], bobs, false); status != http.StatusBadRequest {
+		t.Errorf("expected a short key to be refused, got %d", status)
+	}
+
+	var got keyRequest
+	json.NewDecoder(env.get(t, "/users/alice/key").Body).Decode(&got)
+	if got.PublicKey != base64.StdEncoding.EncodeToString(key1) {
+		t.Errorf("expected the first key, got %q", got.PublicKey)
+	}
+	if status := env.putKey(t, "alice", key2, "", true); status != http.StatusOK {
+		t.Errorf("expected the admin to replace the key, got %d", status)
+	}
+	json.NewDecoder(env.get(t, "/users/alice/key").Body).Decode(&got)
+	if got.PublicKey != base64.StdEncoding.EncodeToString(key2) {
+		t.Errorf("expected the replaced key, got %q", got.PublicKey)
+	}
+	if resp := env.get(t, "/users/bob/key"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected no key for bob, got %d", resp.StatusCode)
+	}
+}
+
+func TestSignedPush(t *testing.T) {
+	env := newTestEnv(t)
+	history := `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "alice", "Group": "g1", "Commit": "abc123"}]`
+	env.vm.script("gethistory.sh", scriptResult{Stdout: history + "\n"})
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	env.putKey(t, "alice", pub, env.enrol(t, "alice"), false)
+
+	now := time.Now()
+	signed := signedPush(priv, "alice", "abc123", "nonce-0001", now)
+	tampered := signedPush(priv, "alice", "abc123", "nonce-0002", now)
+	tampered["Commit"] = "def456"
+	for _, tc := range []struct {
+		name   string
+		body   map[string]interface{}
+		status int
+		err    string
+	}{
+		{"unsigned", map[string]interface{}{"Author": "alice", "Group": "g1", "Commit": "abc123"}, http.StatusForbidden, "must be signed"},
+		{"wrong key", signedPush(other, "alice", "abc123", "nonce-0003", now), http.StatusForbidden, "doesn't match"},
+		{"tampered", tampered, http.StatusForbidden, "doesn't match"},
+		{"stale", signedPush(priv, "alice", "abc123", "nonce-0004", now.Add(-time.Hour)), http.StatusForbidden, "more than"},
+		{"no key", signedPush(priv, "bob", "abc123", "nonce-0005", now), http.StatusForbidden, "no registered key"},
+		{"bad nonce", signedPush(priv, "alice", "abc123", "short", now), http.StatusBadRequest, "Nonce"},
+		{"signed", signed, http.StatusOK, ""},
+		{"replayed", signed, http.StatusForbidden, "already used"},
+	} {
+		pushes := len(env.vm.Commands())
+		resp := env.post(t, "/push", "", tc.body)
+		body := readBody(t, resp)
+		if resp.StatusCode != tc.status || !strings.Contains(body, tc.err) {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.name, tc.status, tc.err, resp.StatusCode, body)
+		}
+		if ran := len(env.vm.Commands()) > pushes; ran != (tc.status == http.StatusOK) {
+			t.Errorf("%s: expected push.sh to run only when accepted, ran %v", tc.name, ran)
+		}
+	}
+
+	// an author without a key may still push unsigned
+	if resp := env.post(t, "/push", "", map[string]interface{}{"Author": "bob", "Group": "g1", "Commit": "abc124", "Parent": "abc123"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected bob's unsigned push to succeed, got %d", resp.StatusCode)
+	}
+
+	var got struct{ Result []historyEntry }
+	json.NewDecoder(env.post(t, "/history", "", map[string]interface{}{"Group": "g1"}).Body).Decode(&got)
+	sig := got.Result[0].Metadata
+	if sig == nil || sig.Signed == nil || sig.Signed.Key != base64.StdEncoding.EncodeToString(pub) ||
+		sig.Signed.Signature != signed["Signature"] || sig.Signed.Nonce != "nonce-0001" {
+		t.Fatalf("expected the signature with the commit, got %+v", sig)
+	}
+	// anyone can check it again from the history
+	raw, _ := base64.StdEncoding.DecodeString(sig.Signed.Signature)
+	if !ed25519.Verify(pub, pushSigningPayload("g1", "abc123", sig.Signed.SignedAt, sig.Signed.Nonce), raw) {
+		t.Error("expected the recorded signature to verify")
+	}
+}
+
+func TestSignaturesRequired(t *testing.T) {
+	env := newTestEnv(t)
+	cfg.PushSignatures = signaturesRequire
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+
+	resp := env.post(t, "/push", "", map[string]interface{}{"Author": "bob", "Group": "g1", "Commit": "abc123"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "pushes must be signed") {
+		t.Errorf("expected an unsigned push to be refused, got %d %q", resp.StatusCode, body)
+	}
+
+	// nor through another operation running push.sh
+	reg, err := parseOperations([]byte(`[{"Name": "submit", "Script": "push.sh", "Role": "student",
+		"Args": [{"Name": "Author"}, {"Name": "Group"}, {"Name": "Commit"}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := customOps.reg
+	customOps.reg = reg
+	defer func() { customOps.reg = old }()
+	resp = env.post(t, "/ops/submit", "", map[string]interface{}{"Author": "bob", "Group": "g1", "Commit": "abc123"})
+	if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "pushes must be signed") {
+		t.Errorf("expected an unsigned custom push to be refused, got %d %q", resp.StatusCode, body)
+	}
+
+	cfg.PushSignatures = signaturesOff
+	_, priv, _ := ed25519.GenerateKey(nil)
+	if resp := env.post(t, "/push", "", signedPush(priv, "bob", "abc123", "nonce-1000", time.Now())); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected signatures to be ignored when off, got %d", resp.StatusCode)
+	}
+}
+
+func TestSignedPushRetriedAfterLock(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("push.sh", scriptResult{Stdout: "Committed\n"})
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	env.putKey(t, "alice", pub, env.enrol(t, "alice"), false)
+	signed := signedPush(priv, "alice", "abc123", "nonce-0001", time.Now())
+
+	// another script holds the network, the push never runs
+	release, ok := locks.tryLock(lockGlobal, "")
+	if !ok {
+		t.Fatal("expected to take the lock")
+	}
+	resp := env.post(t, "/push", "", signed)
+	readBody(t, resp)
+	release()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the push to be locked out, got %d", resp.StatusCode)
+	}
+
+	// the same signed push goes through once the network is free
+	resp = env.post(t, "/push", "", signed)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the retry to succeed, got %d %s", resp.StatusCode, body)
+	}
+	resp = env.post(t, "/push", "", signed)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "already used") {
+		t.Errorf("expected a replay to be refused, got %d %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// simulator runs the bloc-server scripts in process against a fake ledger,
+// so the server can be developed, demoed and tested with no VM. It follows
+// the scripts: init brings the network up, clear tears it down, every group
+// gets its own channel and pushes are appended to the channel ledger.
+type simulator struct {
+	mu    sync.Mutex
+	file  string
+	state simState
+}
+
+// simState is the simulated network, as saved to the simulator file
+type simState struct {
+	Up       bool
+	Channels map[string]*simChannel
+}
+
+// simChannel is the channel of a group
+type simChannel struct {
+	Members []string
+	Ledger  []historyEntry
+}
+
+// errNetworkDown is returned by the scripts needing a network before init
+var errNetworkDown = errors.New("network is down, run init first")
+
+// newSimulator returns a simulator keeping its ledger in file, read back if
+// it exists, or in memory when file is empty
+func newSimulator(file string) (*simulator, error) {
+	sim := &simulator{file: file, state: simState{Channels: map[string]*simChannel{}}}
+	if file == "" {
+		return sim, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return sim, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sim.state); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if sim.state.Channels == nil {
+		sim.state.Channels = map[string]*simChannel{}
+	}
+	return sim, nil
+}
+
+// connect returns the simulator itself, there is nothing to dial
+func (sim *simulator) connect() (scriptConn, error) {
+	return sim, nil
+}
+
+// ready checks the ledger can be saved, by creating a file next to it as
+// save does, the ledger itself is left alone
+func (sim *simulator) ready(ctx context.Context, checks map[string]checkResult) {
+	checks["simulator"] = timed(func() error {
+		if sim.file == "" {
+			return nil
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(sim.file), ".simulator-*")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	})
+}
+
+func (sim *simulator) Close() error {
+	return nil
+}
+
+// run runs the script of op with args, its output and errors going to j as
+// they would from the VM
+func (sim *simulator) run(ctx context.Context, op *operation, args []string, j *job) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	err := sim.script(&stdout, op.scriptName(), args)
+
+	outLines := j.output("stdout")
+	outLines.Write(stdout.Bytes())
+	outLines.flush()
+	if err != nil {
+		errLines := j.output("stderr")
+		fmt.Fprintln(errLines, "Error:", err)
+		errLines.flush()
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// script runs one bloc-server script, writing what it prints to out. A
+// script whose ledger can't be saved leaves nothing behind.
+func (sim *simulator) script(out *bytes.Buffer, script string, args []string) error {
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	prev := sim.state.clone()
+
+	switch script {
+	case "test.sh":
+		fmt.Fprintln(out, strings.Join(args, " "))
+		return nil
+
+	case "init.sh":
+		if sim.state.Up {
+			return errors.New("network is already up, run clear first")
+		}
+		sim.state.Up = true
+		fmt.Fprintln(out, "Network up")
+
+	case "clear.sh":
+		sim.state = simState{Channels: map[string]*simChannel{}}
+		fmt.Fprintln(out, "Network down, ledger cleared")
+
+	case "createchannel.sh":
+		author, group := arg(0), arg(1)
+		if !sim.state.Up {
+			return errNetworkDown
+		}
+		if group == "" {
+			return errors.New("usage: createchannel.sh <author> <group>")
+		}
+		ch := sim.state.Channels[group]
+		if ch == nil {
+			ch = &simChannel{Members: []string{}, Ledger: []historyEntry{}}
+			sim.state.Channels[group] = ch
+			fmt.Fprintf(out, "Channel '%s' created\n", group)
+		}
+		for _, m := range ch.Members {
+			if m == author {
+				fmt.Fprintf(out, "%s already joined channel '%s'\n", author, group)
+				return nil
+			}
+		}
+		ch.Members = append(ch.Members, author)
+		fmt.Fprintf(out, "%s joined channel '%s'\n", author, group)
+
+	case "push.sh":
+		author, group, commit := arg(0), arg(1), arg(2)
+		ch, err := sim.channel(group)
+		if err != nil {
+			return err
+		}
+		if commit == "" {
+			return errors.New("usage: push.sh <author> <group> <commit>")
+		}
+		txID := make([]byte, 32)
+		rand.Read(txID)
+		entry := historyEntry{
+			TxID:      hex.EncodeToString(txID),
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Author:    author,
+			Group:     group,
+			Commit:    commit,
+		}
+		ch.Ledger = append(ch.Ledger, entry)
+		fmt.Fprintf(out, "Commit %s pushed to channel '%s', transaction %s\n", commit, group, entry.TxID)
+
+	case "gethistory.sh":
+		ch, err := sim.channel(arg(0))
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(ch.Ledger, "", "  ")
+		out.Write(data)
+		out.WriteString("\n")
+		return nil
+
+	default:
+		return fmt.Errorf("%s: command not found", script)
+	}
+	if err := sim.save(); err != nil {
+		sim.state = prev
+		out.Reset()
+		return err
+	}
+	return nil
+}
+
+// clone returns a copy of st sharing nothing with it
+func (st simState) clone() simState {
+	c := simState{Up: st.Up, Channels: make(map[string]*simChannel, len(st.Channels))}
+	for group, ch := range st.Channels {
+		c.Channels[group] = &simChannel{
+			Members: append([]string{}, ch.Members...),
+			Ledger:  append([]historyEntry{}, ch.Ledger...),
+		}
+	}
+	return c
+}
+
+// channel returns the channel of group, which must have been created
+func (sim *simulator) channel(group string) (*simChannel, error) {
+	if !sim.state.Up {
+		return nil, errNetworkDown
+	}
+	ch := sim.state.Channels[group]
+	if ch == nil {
+		return nil, fmt.Errorf("channel '%s' does not exist", group)
+	}
+	return ch, nil
+}
+
+// save writes the ledger to the simulator file, if any. The file is
+// replaced at once so a crash never leaves half a ledger.
+func (sim *simulator) save() error {
+	if sim.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(sim.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(sim.file), ".simulator-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), sim.file)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// simulate runs the operation name on sim as the handlers would
+func simulate(t *testing.T, sim *simulator, name string, args ...string) (string, error) {
+	t.Helper()
+	reg, err := loadOperations("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldVM := vm
+	vm = sim
+	defer func() { vm = oldVM }()
+
+	out, err := runScript(context.Background(), httptest.NewRecorder(), reg.byName[name], args, "")
+	return string(out), err
+}
+
+func TestSimulatorLedger(t *testing.T) {
+	sim, err := newSimulator("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := simulate(t, sim, "creategroup", "alice", "g1"); err == nil || !strings.Contains(err.Error(), "network is down") {
+		t.Fatalf("expected the network to be down before init, got %v", err)
+	}
+	if _, err := simulate(t, sim, "init", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := simulate(t, sim, "push", "alice", "g1", "abc123"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected an unknown group to fail, got %v", err)
+	}
+	for _, author := range []string{"alice", "bob"} {
+		if _, err := simulate(t, sim, "creategroup", author, "g1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if members := sim.state.Channels["g1"].Members; len(members) != 2 {
+		t.Fatalf("expected both members in the channel, got %q", members)
+	}
+	for _, commit := range []string{"abc123", "def456"} {
+		if _, err := simulate(t, sim, "push", "alice", "g1", commit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := simulate(t, sim, "history", "g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := parseHistory(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Commit != "abc123" || entries[1].Commit != "def456" {
+		t.Fatalf("expected the pushes in order, got %+v", entries)
+	}
+	if entries[0].TxID == "" || entries[0].Timestamp == "" || entries[0].Author != "alice" {
+		t.Errorf("expected complete records, got %+v", entries[0])
+	}
+
+	if _, err := simulate(t, sim, "clear"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := simulate(t, sim, "history", "g1"); err == nil {
+		t.Fatal("expected the ledger to be gone after clear")
+	}
+}
+
+func TestSimulatorFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ledger.json")
+	sim, err := newSimulator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range [][]string{{"init", "admin"}, {"creategroup", "alice", "g1"}, {"push", "alice", "g1", "abc123"}} {
+		if _, err := simulate(t, sim, op[0], op[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reopened, err := newSimulator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := simulate(t, reopened, "history", "g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "abc123") {
+		t.Fatalf("expected the ledger to survive a restart, got %s", out)
+	}
+}
+
+func TestSimulatorSaveFailure(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "ledger.json")
+	sim, err := newSimulator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range [][]string{{"init", "admin"}, {"creategroup", "alice", "g1"}} {
+		if _, err := simulate(t, sim, op[0], op[1:]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// probing readiness doesn't rewrite the ledger
+	if err := ioutil.WriteFile(file, []byte("saved"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checks := map[string]checkResult{}
+	sim.ready(context.Background(), checks)
+	if data, _ := ioutil.ReadFile(file); checks["simulator"].Status != "ok" || string(data) != "saved" {
+		t.Fatalf("expected a ready simulator and the ledger untouched, got %+v %q", checks, data)
+	}
+
+	// a file in place of the directory, even root can't save there
+	notDir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sim.file = filepath.Join(notDir, "ledger.json")
+	sim.ready(context.Background(), checks)
+	if checks["simulator"].Status != "failed" {
+		t.Errorf("expected the simulator not to be ready, got %+v", checks)
+	}
+	if out, err := simulate(t, sim, "push", "alice", "g1", "abc123"); err == nil || out != "" {
+		t.Fatalf("expected the push to fail, got %q %v", out, err)
+	}
+	if ledger := sim.state.Channels["g1"].Ledger; len(ledger) != 0 {
+		t.Errorf("expected the failed push to be rolled back, got %+v", ledger)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// scriptResult is what the test ssh server answers to a command
+type scriptResult struct {
+	Stdout string
+	Stderr string
+	Status uint32
+	// Wait, when set, holds the command until it is closed or the client
+	// signals or closes the session
+	Wait chan struct{}
+}
+
+// testSSHServer is an in process ssh server standing in for the VM. It
+// accepts a password and public keys, records every command it is asked to
+// run and answers with the results scripted for them.
+type testSSHServer struct {
+	Addr     string
+	User     string
+	Password string
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu       sync.Mutex
+	keys     []ssh.PublicKey
+	results  map[string]scriptResult
+	commands []string
+	signals  []string
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// newTestSSHServer starts a server on a free local port, stopped when the
+// test ends
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &testSSHServer{User: "azureuser", Password: "vm-secret", results: map[string]scriptResult{}, conns: map[net.Conn]bool{}}
+	ts.config = &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == ts.User && string(password) == ts.Password {
+				return nil, nil
+			}
+			return nil, errAuth
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			ts.mu.Lock()
+			defer ts.mu.Unlock()
+			for _, k := range ts.keys {
+				if c.User() == ts.User && string(k.Marshal()) == string(key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errAuth
+		},
+	}
+	ts.config.AddHostKey(signer)
+
+	ts.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.Addr = ts.listener.Addr().String()
+
+	ts.wg.Add(1)
+	go ts.serve()
+	t.Cleanup(ts.close)
+	return ts
+}
+
+var errAuth = errors.New("wrong credentials")
+
+// authorize lets key log in as the user
+func (ts *testSSHServer) authorize(key ssh.PublicKey) {
+	ts.mu.Lock()
+	ts.keys = append(ts.keys, key)
+	ts.mu.Unlock()
+}
+
+// script answers res to the commands running script, e.g. "push.sh".
+// Commands with no scripted result succeed with no output.
+func (ts *testSSHServer) script(script string, res scriptResult) {
+	ts.mu.Lock()
+	ts.results[script] = res
+	ts.mu.Unlock()
+}
+
+// Commands returns the commands run so far, in order
+func (ts *testSSHServer) Commands() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]string(nil), ts.commands...)
+}
+
+// Signals returns the signals clients sent to their commands
+func (ts *testSSHServer) Signals() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]string(nil), ts.signals...)
+}
+
+// result returns what to answer to cmd
+func (ts *testSSHServer) result(cmd string) scriptResult {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.commands = append(ts.commands, cmd)
+	for script, res := range ts.results {
+		if strings.Contains(cmd, "/"+script+"'") {
+			return res
+		}
+	}
+	return scriptResult{}
+}
+
+func (ts *testSSHServer) close() {
+	ts.listener.Close()
+	ts.mu.Lock()
+	for conn := range ts.conns {
+		conn.Close()
+	}
+	ts.mu.Unlock()
+	ts.wg.Wait()
+}
+
+func (ts *testSSHServer) serve() {
+	defer ts.wg.Done()
+	for {
+		conn, err := ts.listener.Accept()
+		if err != nil {
+			return
+		}
+		ts.wg.Add(1)
+		go func() {
+			defer ts.wg.Done()
+			ts.handleConn(conn)
+		}()
+	}
+}
+
+func (ts *testSSHServer) handleConn(conn net.Conn) {
+	ts.mu.Lock()
+	ts.conns[conn] = true
+	ts.mu.Unlock()
+	defer func() {
+		ts.mu.Lock()
+		delete(ts.conns, conn)
+		ts.mu.Unlock()
+		conn.Close()
+	}()
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, ts.config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.handleSession(ch, reqs)
+		}()
+	}
+	wg.Wait()
+}
+
+// handleSession runs the single exec request of a session
+func (ts *testSSHServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	// stopped is closed when the client signals the command or goes away
+	stopped := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() { stopOnce.Do(func() { close(stopped) }) }
+	defer stop()
+
+	execs := make(chan string, 1)
+	go func() {
+		for req := range reqs {
+			switch req.Type {
+			case "exec":
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+				execs <- payload.Command
+			case "signal":
+				var payload struct{ Signal string }
+				ssh.Unmarshal(req.Payload, &payload)
+				ts.mu.Lock()
+				ts.signals = append(ts.signals, payload.Signal)
+				ts.mu.Unlock()
+				stop()
+			default:
+				req.Reply(false, nil)
+			}
+		}
+		// the client closed the session
+		stop()
+	}()
+
+	var cmd string
+	select {
+	case cmd = <-execs:
+	case <-stopped:
+		return
+	}
+
+	res := ts.result(cmd)
+	ch.Write([]byte(res.Stdout))
+	ch.Stderr().Write([]byte(res.Stderr))
+	if res.Wait != nil {
+		select {
+		case <-res.Wait:
+		case <-stopped:
+			return
+		}
+	}
+
+	status := struct{ Status uint32 }{res.Status}
+	ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// activity buckets selectable with the bucket parameter
+const (
+	bucketDay  = "day"
+	bucketWeek = "week"
+)
+
+// maxActivityBuckets bounds the activity of a report, a history spanning
+// more days or weeks only shows its last ones
+const maxActivityBuckets = 1000
+
+// authorStats is the contribution of an author to a group
+type authorStats struct {
+	Author        string
+	StudentNumber string `json:",omitempty"`
+	Pushes        int
+	// Share is the fraction of the pushes of the group, 0 to 1
+	Share float64
+	// First and Last are the timestamps of the first and last push
+	First string `json:",omitempty"`
+	Last  string `json:",omitempty"`
+}
+
+// activityBucket counts the pushes of a day or week
+type activityBucket struct {
+	// Start is the day, or the monday of the week, in UTC
+	Start    string
+	Pushes   int
+	ByAuthor map[string]int `json:",omitempty"`
+}
+
+// groupStats is the contribution report of a group
+type groupStats struct {
+	Group  string
+	Pushes int
+	Bucket string
+	// Authors are the members and everyone who pushed, most pushes first
+	Authors  []authorStats
+	Activity []activityBucket
+	// Inequality is the Gini coefficient of the pushes of Authors: 0 when
+	// everyone pushed as much, near 1 when one did all of it
+	Inequality float64
+}
+
+// gini returns the Gini coefficient of counts
+func gini(counts []int) float64 {
+	n, total := len(counts), 0
+	sorted := append([]int(nil), counts...)
+	sort.Ints(sorted)
+	weighted := 0
+	for i, c := range sorted {
+		total += c
+		weighted += (i + 1) * c
+	}
+	if n < 2 || total == 0 {
+		return 0
+	}
+	return 2*float64(weighted)/float64(n*total) - float64(n+1)/float64(n)
+}
+
+// bucketStart returns the start of the bucket of t
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if bucket == bucketWeek {
+		// weeks start on monday
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return day
+}
+
+// contributionStats computes the report of group from its history. members
+// are counted even without a push, numbers gives the student number of an
+// author.
+func contributionStats(group string, entries []historyEntry, members []string, bucket string, numbers func(string) string) groupStats {
+	stats := groupStats{Group: group, Pushes: len(entries), Bucket: bucket, Authors: []authorStats{}, Activity: []activityBucket{}}
+
+	// the first and last pushes are compared as times, the timestamps may
+	// not share an offset
+	type tally struct {
+		authorStats
+		first, last time.Time
+	}
+	byAuthor := map[string]*tally{}
+	author := func(name string) *tally {
+		if byAuthor[name] == nil {
+			byAuthor[name] = &tally{authorStats: authorStats{Author: name, StudentNumber: numbers(name)}}
+		}
+		return byAuthor[name]
+	}
+	for _, m := range members {
+		author(m)
+	}
+
+	buckets := map[time.Time]*activityBucket{}
+	var first, last time.Time
+	for _, e := range entries {
+		a := author(e.Author)
+		a.Pushes++
+		ts, err := time.Parse(time.RFC3339, e.Timestamp)
+		if err != nil {
+			// counted, but not placed in time
+			continue
+		}
+		if a.first.IsZero() || ts.Before(a.first) {
+			a.first, a.First = ts, e.Timestamp
+		}
+		if a.last.IsZero() || ts.After(a.last) {
+			a.last, a.Last = ts, e.Timestamp
+		}
+
+		start := bucketStart(ts, bucket)
+		if buckets[start] == nil {
+			buckets[start] = &activityBucket{Start: start.Format("2006-01-02"), ByAuthor: map[string]int{}}
+		}
+		buckets[start].Pushes++
+		buckets[start].ByAuthor[e.Author]++
+		if first.IsZero() || start.Before(first) {
+			first = start
+		}
+		if start.After(last) {
+			last = start
+		}
+	}
+
+	// the quiet days or weeks are part of the picture
+	if !first.IsZero() {
+		step := func(t time.Time, n int) time.Time {
+			if bucket == bucketWeek {
+				return t.AddDate(0, 0, 7*n)
+			}
+			return t.AddDate(0, 0, n)
+		}
+		if step(first, maxActivityBuckets).Before(last) {
+			first = step(last, 1-maxActivityBuckets)
+		}
+		for t := first; !t.After(last); t = step(t, 1) {
+			b := buckets[t]
+			if b == nil {
+				b = &activityBucket{Start: t.Format("2006-01-02")}
+			}
+			stats.Activity = append(stats.Activity, *b)
+		}
+	}
+
+	counts := make([]int, 0, len(byAuthor))
+	for _, a := range byAuthor {
+		if stats.Pushes > 0 {
+			a.Share = float64(a.Pushes) / float64(stats.Pushes)
+		}
+		stats.Authors = append(stats.Authors, a.authorStats)
+		counts = append(counts, a.Pushes)
+	}
+	sort.Slice(stats.Authors, func(i, j int) bool {
+		a, b := stats.Authors[i], stats.Authors[j]
+		return a.Pushes > b.Pushes || a.Pushes == b.Pushes && a.Author < b.Author
+	})
+	stats.Inequality = gini(counts)
+	return stats
+}
+
+// getStats reports who contributed what to a group and when, from its
+// history on chain and its members
+func (oh opHandler) getStats(history *operation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdminRequest(r) {
+			http.Error(w, "Wrong Password", http.StatusForbidden)
+			return
+		}
+		if history == nil {
+			http.Error(w, "No history operation to compute statistics from", http.StatusNotImplemented)
+			return
+		}
+		bucket := r.URL.Query().Get("bucket")
+		switch bucket {
+		case "":
+			bucket = bucketDay
+		case bucketDay, bucketWeek:
+		default:
+			http.Error(w, "bucket must be day or week", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		group := mux.Vars(r)["Group"]
+		members, err := oh.uh.store.members(ctx, group)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries, err := oh.historyOf(ctx, w, history, group)
+		if err != nil {
+			writeScriptError(w, err)
+			return
+		}
+
+		sn := &studentNumbers{st: oh.uh.store, seen: map[string]string{}}
+		numbers := func(author string) string {
+			n, err := sn.of(ctx, author)
+			if err != nil {
+				loggerFrom(ctx).Warn("can't read the student number", "author", author, "error", err)
+			}
+			return n
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(contributionStats(group, entries, members, bucket, numbers))
+	}
+}
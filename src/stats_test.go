@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGini(t *testing.T) {
+	for _, tc := range []struct {
+		counts []int
+		want   float64
+	}{
+		{nil, 0},
+		{[]int{5}, 0},
+		{[]int{0, 0}, 0},
+		{[]int{3, 3, 3}, 0},
+		{[]int{4, 0}, 0.5},
+		{[]int{0, 0, 0, 9}, 0.75},
+		{[]int{1, 2, 3}, 2.0 / 9},
+	} {
+		if got := gini(tc.counts); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%v: expected %v, got %v", tc.counts, tc.want, got)
+		}
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	// just past midnight on monday in Amsterdam, still sunday in UTC
+	ts, _ := time.Parse(time.RFC3339, "2021-03-08T00:30:00+01:00")
+	if got := bucketStart(ts, bucketDay).Format("2006-01-02"); got != "2021-03-07" {
+		t.Errorf("expected the day in UTC, got %s", got)
+	}
+	if got := bucketStart(ts, bucketWeek).Format("2006-01-02"); got != "2021-03-01" {
+		t.Errorf("expected the monday before, got %s", got)
+	}
+}
+
+func TestContributionStats(t *testing.T) {
+	entries := []historyEntry{
+		{Timestamp: "2021-03-01T10:00:00Z", Author: "alice", Commit: "a1"},
+		{Timestamp: "2021-03-03T09:00:00+01:00", Author: "alice", Commit: "a2"},
+		{Timestamp: "2021-03-03T12:00:00Z", Author: "bob", Commit: "b1"},
+		{Timestamp: "not a time", Author: "alice", Commit: "a3"},
+	}
+	numbers := map[string]string{"alice": "s1"}
+	stats := contributionStats("g1", entries, []string{"alice", "carol"}, bucketDay, func(a string) string { return numbers[a] })
+
+	wantAuthors := []authorStats{
+		{Author: "alice", StudentNumber: "s1", Pushes: 3, Share: 0.75, First: "2021-03-01T10:00:00Z", Last: "2021-03-03T09:00:00+01:00"},
+		{Author: "bob", Pushes: 1, Share: 0.25, First: "2021-03-03T12:00:00Z", Last: "2021-03-03T12:00:00Z"},
+		{Author: "carol"},
+	}
+	if !reflect.DeepEqual(stats.Authors, wantAuthors) {
+		t.Errorf("expected %+v, got %+v", wantAuthors, stats.Authors)
+	}
+	wantActivity := []activityBucket{
+		{Start: "2021-03-01", Pushes: 1, ByAuthor: map[string]int{"alice": 1}},
+		{Start: "2021-03-02"},
+		{Start: "2021-03-03", Pushes: 2, ByAuthor: map[string]int{"alice": 1, "bob": 1}},
+	}
+	if !reflect.DeepEqual(stats.Activity, wantActivity) {
+		t.Errorf("expected %+v, got %+v", wantActivity, stats.Activity)
+	}
+	if stats.Pushes != 4 || math.Abs(stats.Inequality-gini([]int{3, 1, 0})) > 1e-9 {
+		t.Errorf("expected 4 pushes and the gini of 3, 1, 0, got %+v", stats)
+	}
+
+	weekly := contributionStats("g1", entries, nil, bucketWeek, func(string) string { return "" })
+	if len(weekly.Activity) != 1 || weekly.Activity[0].Start != "2021-03-01" || weekly.Activity[0].Pushes != 3 {
+		t.Errorf("expected a single week, got %+v", weekly.Activity)
+	}
+
+	empty := contributionStats("g2", nil, nil, bucketDay, func(string) string { return "" })
+	if empty.Authors == nil || empty.Activity == nil || empty.Inequality != 0 {
+		t.Errorf("expected an empty report, got %+v", empty)
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	env := newTestEnv(t)
+	env.vm.script("createchannel.sh", scriptResult{Stdout: "Channel created\n"})
+	history := `[{"TxId": "tx1", "Timestamp": "2021-03-01T10:00:00Z", "Author": "alice", "Commit": "abc123"},
+		{"TxId": "tx2", "Timestamp": "2021-03-09T11:00:00Z", "Author": "alice", "Commit": "def456"}]`
+	env.vm.script("gethistory.sh", scriptResult{Stdout: history + "\n"})
+	for _, m := range []string{"alice", "bob"} {
+		env.post(t, "/creategroup", "", map[string]interface{}{"Author": m, "Group": "g1"}).Body.Close()
+	}
+	env.post(t, "/registernumber", "", map[string]interface{}{"Author": "bob", studentNumberField: "s7654321"}).Body.Close()
+
+	// stats returns the answer to an admin query
+	stats := func(query, password string) (int, groupStats) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", env.srv.URL+"/groups/g1/stats"+query, nil)
+		req.Header.Set(adminPasswordHeader, password)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var gs groupStats
+		json.NewDecoder(resp.Body).Decode(&gs)
+		return resp.StatusCode, gs
+	}
+
+	status, gs := stats("?bucket=week", env.vm.Password)
+	if status != http.StatusOK || gs.Bucket != bucketWeek || gs.Pushes != 2 || len(gs.Activity) != 2 || gs.Inequality != 0.5 {
+		t.Fatalf("expected two weeks of alice alone, got %d %+v", status, gs)
+	}
+	if bob := gs.Authors[1]; bob.Author != "bob" || bob.StudentNumber != "s7654321" || bob.Pushes != 0 {
+		t.Errorf("expected bob with no push, got %+v", bob)
+	}
+	if status, gs = stats("", env.vm.Password); status != http.StatusOK || gs.Bucket != bucketDay || len(gs.Activity) != 9 {
+		t.Errorf("expected nine days, got %d %+v", status, gs.Activity)
+	}
+	if status, _ = stats("?bucket=month", env.vm.Password); status != http.StatusBadRequest {
+		t.Errorf("expected a bad bucket to be refused, got %d", status)
+	}
+	if status, _ = stats("", "alice"); status != http.StatusForbidden {
+		t.Errorf("expected a wrong password to be refused, got %d", status)
+	}
+}
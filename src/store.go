@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// stores selectable in the config
+const (
+	storeRedis  = "redis"
+	storeMemory = "memory"
+)
+
+// store keeps the data of the server: the registered users and their keys,
+// the members of each group, the metadata of the pushed commits, the jobs
+// cut off by a shutdown and the audit log. It also carries the group events,
+// between replicas when it is shared.
+type store interface {
+	// saveUser sets fields on the user id, creating it if needed
+	saveUser(ctx context.Context, id string, fields map[string]interface{}) error
+	// user returns the fields of the user id, empty if it is unknown
+	user(ctx context.Context, id string) (map[string]string, error)
+
+	// setPublicKey records the public key of author. An existing key is
+	// only replaced with replace set, the return tells if key was recorded.
+	setPublicKey(ctx context.Context, author string, key []byte, replace bool) (bool, error)
+	// publicKey returns the public key of author, nil if none
+	publicKey(ctx context.Context, author string) ([]byte, error)
+	// addEnrolment lets the holder of token register the first key of
+	// author, once, until ttl runs out
+	addEnrolment(ctx context.Context, author, token string, ttl time.Duration) error
+	// useEnrolment spends the enrolment token of author, it returns false
+	// if it was never issued, expired or was already spent
+	useEnrolment(ctx context.Context, author, token string) (bool, error)
+	// useNonce remembers the nonce of a signature by author for ttl, it
+	// returns false if it was already used
+	useNonce(ctx context.Context, author, nonce string, ttl time.Duration) (bool, error)
+	// forgetNonce makes the nonce of author usable again
+	forgetNonce(ctx context.Context, author, nonce string) error
+
+	// addMember records author as a member of group
+	addMember(ctx context.Context, group, author string) error
+	// members returns the members of group, sorted
+	members(ctx context.Context, group string) ([]string, error)
+	// groups returns the groups with at least one member, sorted
+	groups(ctx context.Context) ([]string, error)
+
+	// saveCommit records the metadata of commit, pushed to group
+	saveCommit(ctx context.Context, group, commit string, meta commitMetadata) error
+	// commits returns the metadata recorded for hashes in group, the
+	// commits without any are left out
+	commits(ctx context.Context, group string, hashes []string) (map[string]commitMetadata, error)
+
+	// indexCommits adds the first push of each commit of entries to the
+	// commit index of group, keeping the commits already indexed. With
+	// complete, entries are the whole history: they replace the index,
+	// whose refresh time is set.
+	indexCommits(ctx context.Context, group string, entries []historyEntry, complete bool) error
+	// indexedCommit returns the first push of hash in the commit index of
+	// group, false if it is not indexed, and the last refresh of the index,
+	// failed refreshes that have not expired included
+	indexedCommit(ctx context.Context, group, hash string) (historyEntry, bool, time.Time, error)
+	// failRefresh records a failed refresh of the commit index of group,
+	// which counts as a refresh but keeps the index; it is forgotten after
+	// ttl
+	failRefresh(ctx context.Context, group string, ttl time.Duration) error
+
+	// indexHashes records where each hash was pushed, in the index shared
+	// by every group
+	indexHashes(ctx context.Context, occs map[string][]hashOccurrence) error
+	// searchHashes returns up to limit hashes starting with prefix, sorted,
+	// with their occurrences. With kind set only the occurrences of that
+	// kind count.
+	searchHashes(ctx context.Context, prefix, kind string, limit int) ([]hashMatch, error)
+	// sharedHashes returns up to limit hashes pushed to more than one
+	// group, sorted, with their occurrences. With kind set only the
+	// occurrences of that kind count.
+	sharedHashes(ctx context.Context, kind string, limit int) ([]hashMatch, error)
+
+	// lineage returns the commit graph of group, by commit
+	lineage(ctx context.Context, group string) (map[string]commitNode, error)
+	// addCommitNode adds node to the graph of group with the lineageFlags
+	// it gets against the graph at that moment, atomically, and returns
+	// them. A duplicate commit is not recorded again, nor with strict a
+	// node with flags.
+	addCommitNode(ctx context.Context, group string, node commitNode, strict bool) ([]string, error)
+	// removeCommitNode takes commit out of the graph of group
+	removeCommitNode(ctx context.Context, group, commit string) error
+
+	// saveJob records the state of a job
+	saveJob(ctx context.Context, info jobInfo) error
+	// job returns the recorded state of the job id, false if unknown
+	job(ctx context.Context, id string) (jobInfo, bool, error)
+
+	// audit appends e to the audit log, which keeps the last
+	// maxAuditEntries
+	audit(ctx context.Context, e auditEntry) error
+	// auditLog returns up to n entries of the audit log, newest first
+	auditLog(ctx context.Context, n int) ([]auditEntry, error)
+
+	// publish sends payload to the subscribers of channel
+	publish(ctx context.Context, channel string, payload []byte) error
+	// subscribe listens to channels until the subscription is closed. It
+	// only returns once the subscription is active.
+	subscribe(ctx context.Context, channels ...string) (*subscription, error)
+
+	// clear deletes everything, as when the network is torn down
+	clear(ctx context.Context) error
+	// ready adds the checks of the store to a readiness report
+	ready(ctx context.Context, checks map[string]checkResult)
+	Close() error
+}
+
+// subscription receives the payloads published on its channels
+type subscription struct {
+	C     <-chan []byte
+	close func() error
+}
+
+func (s *subscription) Close() error {
+	return s.close()
+}
+
+// newStore returns the store selected in the config
+func newStore() (store, error) {
+	if cfg.Store == storeMemory {
+		return newMemoryStore(), nil
+	}
+	client, err := newRedisClient()
+	if err != nil {
+		return nil, err
+	}
+	return newRedisStore(client), nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// testRedisEnv names the variable holding the address of a real redis to
+// run the conformance suite against. It is flushed, never point it to a
+// redis in use.
+const testRedisEnv = "TEST_REDIS_ADDR"
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) store {
+		return newMemoryStore()
+	})
+}
+
+func TestRedisStore(t *testing.T) {
+	testStore(t, func(t *testing.T) store {
+		mr, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(mr.Close)
+		rs := newRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+		t.Cleanup(func() { rs.Close() })
+		return rs
+	})
+}
+
+func TestRedisStoreReal(t *testing.T) {
+	addr := os.Getenv(testRedisEnv)
+	if addr == "" {
+		t.Skip("set " + testRedisEnv + " to run against a real redis")
+	}
+	testStore(t, func(t *testing.T) store {
+		rs := newRedisStore(redis.NewClient(&redis.Options{Addr: addr}))
+		t.Cleanup(func() { rs.Close() })
+		if err := rs.clear(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	})
+}
+
+// testStore runs the conformance suite every store must pass, on a new empty
+// store for each test
+func testStore(t *testing.T, newStore func(t *testing.T) store) {
+	ctx := context.Background()
+
+	t.Run("users", func(t *testing.T) {
+		st := newStore(t)
+		if user, err := st.user(ctx, "alice"); err != nil || len(user) != 0 {
+			t.Fatalf("expected no user, got %v %v", user, err)
+		}
+		if err := st.saveUser(ctx, "alice", map[string]interface{}{"Author": "alice", "Group": "g1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := st.saveUser(ctx, "alice", map[string]interface{}{"IP": "10.0.0.7", "Port": 22}); err != nil {
+			t.Fatal(err)
+		}
+		user, err := st.user(ctx, "alice")
+		want := map[string]string{"Author": "alice", "Group": "g1", "IP": "10.0.0.7", "Port": "22"}
+		if err != nil || !reflect.DeepEqual(user, want) {
+			t.Fatalf("expected %v, got %v %v", want, user, err)
+		}
+	})
+
+	t.Run("keys", func(t *testing.T) {
+		st := newStore(t)
+		if key, err := st.publicKey(ctx, "alice"); key != nil || err != nil {
+			t.Fatalf("expected no key, got %x %v", key, err)
+		}
+		if ok, err := st.setPublicKey(ctx, "alice", []byte("key-1"), false); !ok || err != nil {
+			t.Fatalf("expected the first key to be recorded, got %v %v", ok, err)
+		}
+		if ok, _ := st.setPublicKey(ctx, "alice", []byte("key-2"), false); ok {
+			t.Fatal("expected the key not to be replaced")
+		}
+		if key, _ := st.publicKey(ctx, "alice"); string(key) != "key-1" {
+			t.Fatalf("expected key-1, got %q", key)
+		}
+		if ok, _ := st.setPublicKey(ctx, "alice", []byte("key-2"), true); !ok {
+			t.Fatal("expected the key to be replaced")
+		}
+		if key, _ := st.publicKey(ctx, "alice"); string(key) != "key-2" {
+			t.Fatalf("expected key-2, got %q", key)
+		}
+
+		st.addEnrolment(ctx, "alice", "token-1", time.Minute)
+		if ok, err := st.useEnrolment(ctx, "bob", "token-1"); ok || err != nil {
+			t.Fatalf("expected the token to be alice's only, got %v %v", ok, err)
+		}
+		if ok, err := st.useEnrolment(ctx, "alice", "token-1"); !ok || err != nil {
+			t.Fatalf("expected the token to be spent, got %v %v", ok, err)
+		}
+		if ok, _ := st.useEnrolment(ctx, "alice", "token-1"); ok {
+			t.Fatal("expected the token to be spent once")
+		}
+
+		if fresh, err := st.useNonce(ctx, "alice", "n-12345678", time.Minute); !fresh || err != nil {
+			t.Fatalf("expected a new nonce, got %v %v", fresh, err)
+		}
+		if fresh, _ := st.useNonce(ctx, "alice", "n-12345678", time.Minute); fresh {
+			t.Fatal("expected the nonce to be used")
+		}
+		if fresh, _ := st.useNonce(ctx, "bob", "n-12345678", time.Minute); !fresh {
+			t.Fatal("expected nonces to be per author")
+		}
+	})
+
+	t.Run("members", func(t *testing.T) {
+		st := newStore(t)
+		if members, err := st.members(ctx, "g1"); err != nil || len(members) != 0 {
+			t.Fatalf("expected no members, got %q %v", members, err)
+		}
+		for _, author := range []string{"carol", "alice", "carol"} {
+			if err := st.addMember(ctx, "g1", author); err != nil {
+				t.Fatal(err)
+			}
+		}
+		st.addMember(ctx, "g2", "bob")
+		members, err := st.members(ctx, "g1")
+		if err != nil || !reflect.DeepEqual(members, []string{"alice", "carol"}) {
+			t.Fatalf("expected alice and carol, got %q %v", members, err)
+		}
+		groups, err := st.groups(ctx)
+		if err != nil || !reflect.DeepEqual(groups, []string{"g1", "g2"}) {
+			t.Fatalf("expected g1 and g2, got %q %v", groups, err)
+		}
+	})
+
+	t.Run("commits", func(t *testing.T) {
+		st := newStore(t)
+		meta := commitMetadata{
+			Message:   "Add the parser",
+			Artifacts: []artifact{{Path: "src/parser.go", Hash: "a1b2c3d4"}},
+			Received:  time.Now().UTC().Truncate(time.Second),
+		}
+		if err := st.saveCommit(ctx, "g1", "abc123", meta); err != nil {
+			t.Fatal(err)
+		}
+		st.saveCommit(ctx, "g2", "def456", commitMetadata{Message: "other group"})
+
+		metas, err := st.commits(ctx, "g1", []string{"abc123", "def456", "unknown"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]commitMetadata{"abc123": meta}; !reflect.DeepEqual(metas, want) {
+			t.Fatalf("expected %+v, got %+v", want, metas)
+		}
+		if metas, err := st.commits(ctx, "g1", nil); err != nil || len(metas) != 0 {
+			t.Fatalf("expected nothing for no hashes, got %+v %v", metas, err)
+		}
+	})
+
+	t.Run("commit index", func(t *testing.T) {
+		st := newStore(t)
+		if _, ok, refreshed, err := st.indexedCommit(ctx, "g1", "abc123"); ok || !refreshed.IsZero() || err != nil {
+			t.Fatalf("expected an empty index, got %v %v %v", ok, refreshed, err)
+		}
+
+		pushed := historyEntry{TxID: "tx9", Timestamp: "2021-03-01T12:00:00Z", Author: "alice", Group: "g1", Commit: "abc123"}
+		st.indexCommits(ctx, "g1", []historyEntry{pushed}, false)
+		if e, ok, refreshed, _ := st.indexedCommit(ctx, "g1", "abc123"); !ok || e != pushed || !refreshed.IsZero() {
+			t.Fatalf("expected the pushed commit, got %+v %v %v", e, ok, refreshed)
+		}
+
+		// the history replaces the index, keeping the first push
+		history := []historyEntry{
+			{TxID: "tx2", Timestamp: "2021-03-01T11:00:00Z", Author: "bob", Group: "g1", Commit: "abc123"},
+			{TxID: "tx1", Timestamp: "2021-03-01T10:00:00Z", Author: "alice", Group: "g1", Commit: "abc123"},
+			{TxID: "tx3", Timestamp: "2021-03-01T10:30:00Z", Author: "bob", Group: "g1", Commit: "def456"},
+		}
+		if err := st.indexCommits(ctx, "g1", history, true); err != nil {
+			t.Fatal(err)
+		}
+		e, ok, refreshed, err := st.indexedCommit(ctx, "g1", "abc123")
+		if err != nil || !ok || e != history[1] || time.Since(refreshed) > time.Minute {
+			t.Fatalf("expected the first push from the history, got %+v %v %v %v", e, ok, refreshed, err)
+		}
+		if _, ok, _, _ := st.indexedCommit(ctx, "g2", "abc123"); ok {
+			t.Fatal("expected the index to be per group")
+		}
+
+		// a failed refresh counts until it expires, the index stays
+		if err := st.failRefresh(ctx, "g2", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok, refreshed, err := st.indexedCommit(ctx, "g2", "abc123"); ok || time.Since(refreshed) > time.Minute || err != nil {
+			t.Fatalf("expected the failed refresh of g2, got %v %v %v", ok, refreshed, err)
+		}
+		st.failRefresh(ctx, "g1", time.Minute)
+		if e, ok, later, _ := st.indexedCommit(ctx, "g1", "abc123"); !ok || e != history[1] || later.Before(refreshed) {
+			t.Fatalf("expected the failed refresh to keep the index of g1, got %+v %v %v", e, ok, later)
+		}
+	})
+
+	t.Run("hashes", func(t *testing.T) {
+		st := newStore(t)
+		a := hashOccurrence{Kind: hashArtifact, Group: "g1", Commit: "abc123", Path: "main.go", Author: "alice"}
+		b := hashOccurrence{Kind: hashArtifact, Group: "g2", Commit: "fed987", Path: "main.go", Author: "bob"}
+		c := hashOccurrence{Kind: hashCommit, Group: "g1", Commit: "abc123", Author: "alice"}
+		if err := st.indexHashes(ctx, map[string][]hashOccurrence{"00ff11": {a}, "abc123": {c}}); err != nil {
+			t.Fatal(err)
+		}
+		if shared, err := st.sharedHashes(ctx, "", 10); err != nil || len(shared) != 0 {
+			t.Fatalf("expected nothing shared, got %+v %v", shared, err)
+		}
+
+		// indexing twice keeps one occurrence
+		st.indexHashes(ctx, map[string][]hashOccurrence{"00ff11": {b, a}})
+		want := []hashMatch{{Hash: "00ff11", Occurrences: []hashOccurrence{a, b}}}
+		if shared, err := st.sharedHashes(ctx, "", 10); err != nil || !reflect.DeepEqual(shared, want) {
+			t.Fatalf("expected %+v, got %+v %v", want, shared, err)
+		}
+		if found, err := st.searchHashes(ctx, "00ff", "", 10); err != nil || !reflect.DeepEqual(found, want) {
+			t.Fatalf("expected %+v, got %+v %v", want, found, err)
+		}
+		if found, _ := st.searchHashes(ctx, "a", "", 10); len(found) != 1 || found[0].Hash != "abc123" {
+			t.Fatalf("expected abc123, got %+v", found)
+		}
+		if found, _ := st.searchHashes(ctx, "", "", 1); len(found) != 1 || found[0].Hash != "00ff11" {
+			t.Fatalf("expected the limit to keep the first hash, got %+v", found)
+		}
+		if found, _ := st.searchHashes(ctx, "abd", "", 10); len(found) != 0 {
+			t.Fatalf("expected nothing, got %+v", found)
+		}
+
+		// the kind is filtered before the limit
+		st.indexHashes(ctx, map[string][]hashOccurrence{"abc123": {hashOccurrence{Kind: hashCommit, Group: "g2", Commit: "abc123", Author: "bob"}}})
+		if shared, _ := st.sharedHashes(ctx, hashCommit, 1); len(shared) != 1 || shared[0].Hash != "abc123" || len(shared[0].Occurrences) != 2 {
+			t.Fatalf("expected the shared commit, got %+v", shared)
+		}
+		if found, _ := st.searchHashes(ctx, "", hashCommit, 1); len(found) != 1 || found[0].Hash != "abc123" {
+			t.Fatalf("expected the commit, got %+v", found)
+		}
+		if found, _ := st.searchHashes(ctx, "00ff", hashCommit, 10); len(found) != 0 {
+			t.Fatalf("expected no commit, got %+v", found)
+		}
+	})
+
+	t.Run("lineage", func(t *testing.T) {
+		st := newStore(t)
+		if flags, err := st.addCommitNode(ctx, "g1", commitNode{Commit: "aa01", Author: "alice"}, false); err != nil || flags != nil {
+			t.Fatalf("expected the root to be accepted, got %q %v", flags, err)
+		}
+
+		// two teammates pushing on the same head at once, only one wins
+		var wg sync.WaitGroup
+		results := make([][]string, 2)
+		for i, c := range []string{"bb01", "bb02"} {
+			wg.Add(1)
+			go func(i int, c string) {
+				defer wg.Done()
+				flags, err := st.addCommitNode(ctx, "g1", commitNode{Commit: c, Parents: []string{"aa01"}}, false)
+				if err != nil {
+					t.Error(err)
+				}
+				results[i] = flags
+			}(i, c)
+		}
+		wg.Wait()
+		if (results[0] == nil) == (results[1] == nil) {
+			t.Fatalf("expected exactly one stale push, got %q", results)
+		}
+
+		if flags, _ := st.addCommitNode(ctx, "g1", commitNode{Commit: "aa01"}, false); !reflect.DeepEqual(flags, []string{flagDuplicate}) {
+			t.Fatalf("expected a duplicate, got %q", flags)
+		}
+		nodes, err := st.lineage(ctx, "g1")
+		if err != nil || len(nodes) != 3 || nodes["aa01"].Author != "alice" {
+			t.Fatalf("expected 3 commits, got %+v %v", nodes, err)
+		}
+		if other, _ := st.lineage(ctx, "g2"); len(other) != 0 {
+			t.Fatalf("expected g2 to be empty, got %+v", other)
+		}
+
+		// strict leaves what breaks the lineage out
+		if flags, _ := st.addCommitNode(ctx, "g1", commitNode{Commit: "cc01", Parents: []string{"aa01"}}, true); !reflect.DeepEqual(flags, []string{flagStaleParent}) {
+			t.Fatalf("expected a stale push, got %q", flags)
+		}
+		if nodes, _ := st.lineage(ctx, "g1"); len(nodes) != 3 {
+			t.Fatalf("expected the stale push not to be recorded, got %+v", nodes)
+		}
+		if err := st.removeCommitNode(ctx, "g1", "bb01"); err != nil {
+			t.Fatal(err)
+		}
+		if nodes, _ := st.lineage(ctx, "g1"); len(nodes) != 2 || nodes["bb01"].Commit != "" {
+			t.Fatalf("expected bb01 to be removed, got %+v", nodes)
+		}
+	})
+
+	t.Run("jobs", func(t *testing.T) {
+		st := newStore(t)
+		if _, ok, err := st.job(ctx, "j1"); ok || err != nil {
+			t.Fatalf("expected no job, got %v %v", ok, err)
+		}
+		info := jobInfo{ID: "j1", Script: "init.sh", RequestID: "req-1", Role: roleAdmin, State: jobInterrupted, Started: time.Now().UTC().Truncate(time.Second)}
+		if err := st.saveJob(ctx, info); err != nil {
+			t.Fatal(err)
+		}
+		got, ok, err := st.job(ctx, "j1")
+		if err != nil || !ok || !reflect.DeepEqual(got, info) {
+			t.Fatalf("expected %+v, got %+v %v %v", info, got, ok, err)
+		}
+	})
+
+	t.Run("audit", func(t *testing.T) {
+		st := newStore(t)
+		for _, op := range []string{"init", "push", "history"} {
+			e := auditEntry{Time: time.Now().UTC().Truncate(time.Second), Operation: op, Role: roleStudent, Status: 200}
+			if err := st.audit(ctx, e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		entries, err := st.auditLog(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Operation != "history" || entries[1].Operation != "push" {
+			t.Fatalf("expected the last two entries newest first, got %+v", entries)
+		}
+	})
+
+	t.Run("events", func(t *testing.T) {
+		st := newStore(t)
+		sub, err := st.subscribe(ctx, "events:g1", "events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, channel := range []string{"events:g2", "events:g1", "events"} {
+			if err := st.publish(ctx, channel, []byte(channel)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, want := range []string{"events:g1", "events"} {
+			select {
+			case got := <-sub.C:
+				if string(got) != want {
+					t.Fatalf("expected %s, got %s", want, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %s", want)
+			}
+		}
+
+		sub.Close()
+		select {
+		case _, ok := <-sub.C:
+			if ok {
+				t.Fatal("expected no event after closing")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected the subscription to be closed")
+		}
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		st := newStore(t)
+		st.saveUser(ctx, "alice", map[string]interface{}{"Group": "g1"})
+		st.addMember(ctx, "g1", "alice")
+		st.saveJob(ctx, jobInfo{ID: "j1", State: jobInterrupted})
+		st.audit(ctx, auditEntry{Operation: "clear"})
+
+		if err := st.clear(ctx); err != nil {
+			t.Fatal(err)
+		}
+		user, _ := st.user(ctx, "alice")
+		members, _ := st.members(ctx, "g1")
+		groups, _ := st.groups(ctx)
+		_, ok, _ := st.job(ctx, "j1")
+		entries, _ := st.auditLog(ctx, 10)
+		if len(user) != 0 || len(members) != 0 || len(groups) != 0 || ok || len(entries) != 0 {
+			t.Fatalf("expected everything to be gone, got %v %q %q %v %+v", user, members, groups, ok, entries)
+		}
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		st := newStore(t)
+		checks := map[string]checkResult{}
+		st.ready(ctx, checks)
+		for name, c := range checks {
+			if c.Status != "ok" {
+				t.Errorf("expected %s to be ok, got %+v", name, c)
+			}
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sseKeepAlive is how often a comment is sent on an idle stream so proxies
+// don't drop the connection while a script is quiet
+const sseKeepAlive = 15 * time.Second
+
+// jobVisible tells if r may see the job info: the jobs of admin
+// operations, and those saved before jobs had a role, need the admin
+// password
+func jobVisible(r *http.Request, info jobInfo) bool {
+	return info.Role == roleStudent || isAdminRequest(r)
+}
+
+// listJobs returns the running and recently finished jobs r may see
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	visible := []jobInfo{}
+	for _, info := range jobs.list() {
+		if jobVisible(r, info) {
+			visible = append(visible, info)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// getJob returns the state of a single job, looking in the store for the
+// jobs interrupted by an earlier shutdown
+func (uh userHandler) getJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["ID"]
+	var info jobInfo
+	if j := jobs.get(id); j != nil {
+		info = j.info()
+	} else {
+		saved, ok, err := uh.store.job(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Unknown job", http.StatusNotFound)
+			return
+		}
+		info = saved
+	}
+	if !jobVisible(r, info) {
+		http.Error(w, "Wrong Password", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// streamJob sends the output of a job as Server-Sent Events, one event per
+// line, stdout and stderr as separate event types. The output so far is
+// replayed first, the stream ends with an "end" event carrying the job
+// state. A reconnecting client resumes from Last-Event-ID.
+func streamJob(w http.ResponseWriter, r *http.Request) {
+	j := jobs.get(mux.Vars(r)["ID"])
+	if j == nil {
+		http.Error(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+	if !jobVisible(r, j.info()) {
+		http.Error(w, "Wrong Password", http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	offset := 0
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		fmt.Sscanf(id, "%d", &offset)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		lines, next, over, changed := j.follow(offset)
+		for i, l := range lines {
+			writeEvent(w, next-len(lines)+i+1, l.Stream, l.Text)
+		}
+		offset = next
+
+		if over {
+			info, _ := json.Marshal(j.info())
+			writeEvent(w, offset, "end", string(info))
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes a single SSE event, data spanning several lines is
+// split as the format requires
+func writeEvent(w http.ResponseWriter, id int, event, data string) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\n", id, event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// withAdminPassword sets the admin password for the test
+func withAdminPassword(t *testing.T, password string) {
+	oldCfg := cfg
+	t.Cleanup(func() { cfg = oldCfg })
+	cfg = defaultConfig()
+	cfg.VMPassword.Set(password)
+}
+
+func TestStreamJobReplaysOutput(t *testing.T) {
+	withAdminPassword(t, "vm-secret")
+	j, _ := jobs.start(context.Background(), "init.sh", roleAdmin)
+	j.appendLine("stdout", "network up")
+	j.appendLine("stderr", "warning")
+	jobs.finish(j, nil)
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/jobs/"+j.ID+"/stream", nil), map[string]string{"ID": j.ID})
+	rec := httptest.NewRecorder()
+	streamJob(rec, req)
+	if rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "network up") {
+		t.Fatalf("expected the output of an admin job to need the password, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	req.Header.Set(adminPasswordHeader, cfg.VMPassword.Get())
+	rec = httptest.NewRecorder()
+	streamJob(rec, req)
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		"id: 1\nevent: stdout\ndata: network up\n\n",
+		"id: 2\nevent: stderr\ndata: warning\n\n",
+		"event: end\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in stream, got %q", want, body)
+		}
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+}
+
+func TestStreamJobOutOfRangeEventID(t *testing.T) {
+	withAdminPassword(t, "vm-secret")
+	j, _ := jobs.start(context.Background(), "init.sh", roleAdmin)
+	j.appendLine("stdout", "network up")
+	jobs.finish(j, nil)
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/jobs/"+j.ID+"/stream", nil), map[string]string{"ID": j.ID})
+	req.Header.Set("Last-Event-ID", "50")
+	req.Header.Set(adminPasswordHeader, cfg.VMPassword.Get())
+	rec := httptest.NewRecorder()
+	streamJob(rec, req)
+
+	body := rec.Body.String()
+	if strings.Contains(body, "network up") || !strings.Contains(body, "event: end\n") {
+		t.Errorf("expected only the end of the job, got %q", body)
+	}
+}
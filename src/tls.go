@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// client certificate policies selectable in the config
+const (
+	// clientAuthOptional verifies a certificate when the client sends one,
+	// clients without one still log in with their password
+	clientAuthOptional = "optional"
+	// clientAuthRequire refuses clients without a valid certificate
+	clientAuthRequire = "require"
+)
+
+// certReloadInterval is how often the certificate files are checked for
+// a rotation
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves the server certificate and maps the subjects of the
+// client certificates to identities. The files are reloaded when they
+// change, broken files leave the previous ones in place.
+type certReloader struct {
+	mu             sync.RWMutex
+	certFile       string
+	keyFile        string
+	identitiesFile string
+	modTime        time.Time
+	cert           *tls.Certificate
+	identities     map[string]string
+}
+
+var serverTLS = &certReloader{}
+
+// load reads the files of c, if TLS is configured
+func (cr *certReloader) load(c *config) error {
+	cr.mu.Lock()
+	cr.certFile, cr.keyFile, cr.identitiesFile = c.TLSCertFile, c.TLSKeyFile, c.TLSIdentitiesFile
+	cr.mu.Unlock()
+	_, err := cr.reload(true)
+	return err
+}
+
+// reload reads the files again if one of them changed since the last load,
+// or always when force is set. It tells if anything was replaced.
+func (cr *certReloader) reload(force bool) (bool, error) {
+	cr.mu.RLock()
+	certFile, keyFile, identitiesFile, last := cr.certFile, cr.keyFile, cr.identitiesFile, cr.modTime
+	cr.mu.RUnlock()
+	if certFile == "" {
+		return false, nil
+	}
+
+	// a rotation replaces the certificate and key one after the other,
+	// reload once the newest of the files changed
+	var modTime time.Time
+	for _, file := range []string{certFile, keyFile, identitiesFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if !force && modTime.Equal(last) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false, err
+	}
+	var identities map[string]string
+	if identitiesFile != "" {
+		data, err := ioutil.ReadFile(identitiesFile)
+		if err != nil {
+			return false, err
+		}
+		if err := json.Unmarshal(data, &identities); err != nil {
+			return false, fmt.Errorf("%s: %v", identitiesFile, err)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert, cr.identities, cr.modTime = &cert, identities, modTime
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// reloadAndLog reloads the files and logs the outcome
+func (cr *certReloader) reloadAndLog(force bool) {
+	changed, err := cr.reload(force)
+	switch {
+	case err != nil:
+		logger.Error("failed to reload the TLS certificate, keeping the previous one", "file", cr.certFile, "error", err)
+	case changed:
+		logger.Info("reloaded the TLS certificate", "file", cr.certFile)
+	}
+}
+
+// watch reloads the files whenever they change, until ctx is done
+func (cr *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cr.reloadAndLog(false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getCertificate hands the current certificate to every new connection
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// identity returns who the client certificate cert belongs to. Without an
+// identities file it is the common name of the subject, with one only the
+// subjects it lists are known.
+func (cr *certReloader) identity(cert *x509.Certificate) (string, bool) {
+	subject := cert.Subject.String()
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	if cr.identities == nil {
+		if cert.Subject.CommonName != "" {
+			return cert.Subject.CommonName, true
+		}
+		return subject, true
+	}
+	id, ok := cr.identities[subject]
+	return id, ok
+}
+
+// tlsConfig returns the TLS settings of the web server, nil to serve plain
+// HTTP
+func (cr *certReloader) tlsConfig(c *config) (*tls.Config, error) {
+	if c.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	conf := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: cr.getCertificate}
+	if c.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificate found", c.TLSClientCAFile)
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.TLSClientAuth == clientAuthRequire {
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return conf, nil
+}
+
+// clientIdentity returns the identity of the verified client certificate
+// of r, false if there is none or its subject is unknown
+func clientIdentity(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	return serverTLS.identity(r.TLS.PeerCertificates[0])
+}
+
+// requireKnownClient refuses the certificates the department CA signed for
+// subjects missing from the identities file
+func requireKnownClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			if _, ok := clientIdentity(r); !ok {
+				loggerFrom(r.Context()).Warn("unknown client certificate", "subject", r.TLS.PeerCertificates[0].Subject.String())
+				http.Error(w, "Unknown client certificate", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates of the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	ca := &testCA{dir: t.TempDir()}
+	ca.cert, ca.key = ca.issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Department CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// issue signs tmpl with the CA, or self signs it for the CA itself
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := tmpl, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// writePEM writes cert and key to name.crt and name.key, dated mod
+func (ca *testCA) writePEM(t *testing.T, name string, cert *x509.Certificate, key *ecdsa.PrivateKey, mod time.Time) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(ca.dir, name+".crt"), filepath.Join(ca.dir, name+".key")
+	der, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+	return certFile, keyFile
+}
+
+// server issues a certificate for the local test server
+func (ca *testCA) server(t *testing.T, serial int64) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// client issues a client certificate for the lab machine cn
+func (ca *testCA) client(t *testing.T, cn string) tls.Certificate {
+	cert, key := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: []string{"Lab"}, Organization: []string{"Dept"}},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}
+}
+
+func TestServerTLS(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	serverCert, serverKey := ca.server(t, 100)
+	certFile, keyFile := ca.writePEM(t, "server", serverCert, serverKey, now)
+	caFile, _ := ca.writePEM(t, "ca", ca.cert, ca.key, now)
+	identitiesFile := filepath.Join(ca.dir, "identities.json")
+	ioutil.WriteFile(identitiesFile, []byte(`{"CN=lab-01,OU=Lab,O=Dept": "alice"}`), 0600)
+
+	c := defaultConfig()
+	c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile, c.TLSIdentitiesFile = certFile, keyFile, caFile, identitiesFile
+
+	oldTLS := serverTLS
+	serverTLS = &certReloader{}
+	defer func() { serverTLS = oldTLS }()
+	if err := serverTLS.load(c); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := serverTLS.tlsConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: requestLogging(requireKnownClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(identity(r.Context())))
+	})))}
+	go srv.Serve(ln)
+	defer srv.Close()
+	url := "https://" + ln.Addr().String() + "/"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// get returns the serial of the server certificate and the answer, on
+	// a new connection each time
+	get := func(certs ...tls.Certificate) (int64, int, string) {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64(), resp.StatusCode, string(body)
+	}
+
+	if serial, status, body := get(ca.client(t, "lab-01")); serial != 100 || status != http.StatusOK || body != "alice" {
+		t.Errorf("expected lab-01 to be alice, got %d %d %q", serial, status, body)
+	}
+	if _, status, _ := get(ca.client(t, "lab-99")); status != http.StatusForbidden {
+		t.Errorf("expected an unknown subject to be refused, got %d", status)
+	}
+	if _, status, body := get(); status != http.StatusOK || body != "" {
+		t.Errorf("expected clients without certificate to get through, got %d %q", status, body)
+	}
+
+	// rotation
+	rotated, rotatedKey := ca.server(t, 200)
+	ca.writePEM(t, "server", rotated, rotatedKey, now.Add(time.Second))
+	if changed, err := serverTLS.reload(false); !changed || err != nil {
+		t.Fatalf("expected the rotated certificate to be loaded, got %v %v", changed, err)
+	}
+	if serial, _, _ := get(); serial != 200 {
+		t.Errorf("expected the rotated certificate, got serial %d", serial)
+	}
+
+	// a broken rotation keeps the current certificate
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+	os.Chtimes(certFile, now.Add(2*time.Second), now.Add(2*time.Second))
+	if _, err := serverTLS.reload(false); err == nil {
+		t.Fatal("expected a broken certificate to be rejected")
+	}
+	if serial, _, _ := get(); serial != 200 {
+		t.Errorf("expected the previous certificate to be kept, got serial %d", serial)
+	}
+}
+
+func TestClientIdentityWithoutMapping(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.client(t, "lab-02")
+	parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	if id, ok := (&certReloader{}).identity(parsed); !ok || id != "lab-02" {
+		t.Errorf("expected the common name, got %q %v", id, ok)
+	}
+}
+
+func TestLoadConfigTLS(t *testing.T) {
+	_, err := loadConfig([]string{"-config", writeConf(t, validConf+"tlscertfile = server.crt\ntlsidentitiesfile = ids.json\ntlsclientauth = always\n")})
+	if err == nil {
+		t.Fatal("expected validation to fail")
+	}
+	for _, want := range []string{"tlscertfile and tlskeyfile", "tlsidentitiesfile needs", "tlsclientauth"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}